@@ -13,7 +13,6 @@
 //
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
-use std::collections::HashMap;
 use std::sync::{Arc, RwLock};
 
 use futures::future::Either;
@@ -23,8 +22,11 @@ use hyper::{header, Body, Chunk, Request, Response};
 
 use crate::api::{SafeOutput, ViewSet};
 use crate::config::{Config, DataStore};
-use crate::http::{return_400, return_404, return_500, ResponseFuture};
-use crate::storage::{delete_object_metabucket, put_object_metabucket};
+use crate::http::{return_400, return_404, return_500, GenericError, ResponseFuture};
+use crate::storage::{
+    create_datastore_bucket, delete_object_metabucket, put_object_metabucket, CreateBucketError,
+    StorageError,
+};
 
 pub struct ApiDataStores {
     config: Arc<RwLock<Config>>,
@@ -73,6 +75,18 @@ impl ApiDataStores {
         if datastore.bucket == "" {
             return Err(return_400("Bucket cannot be empty."));
         }
+        // Server side encryption
+        if let Some(sse) = &datastore.sse {
+            if !valid_sse(sse) {
+                return Err(return_400(
+                    "Server side encryption must be either `s3` or `kms`.",
+                ));
+            }
+        }
+        // Environment references must resolve, otherwise the datastore can't be loaded
+        if let Err(e) = datastore.clone().resolve_env_references() {
+            return Err(return_400(&e.to_string()));
+        }
         let cfg_read = cfg.read().unwrap();
 
         // Validate name
@@ -100,14 +114,15 @@ impl ApiDataStores {
             }
         };
         let read_cfg = cfg.read().unwrap();
+        // merge into the stored form so `${ENV_VAR}` references are saved as they are
         let mut current_datastore = match read_cfg.datastore.get(pk) {
-            Some(v) => v.clone(),
+            Some(v) => v.to_stored(),
             None => {
                 return Err(return_404());
             }
         };
 
-        let datastore: HashMap<String, String> = match serde_json::from_str(&payload) {
+        let datastore: serde_json::Value = match serde_json::from_str(&payload) {
             Ok(v) => v,
             Err(_) => {
                 return Err(return_400("Could not parse request"));
@@ -115,20 +130,20 @@ impl ApiDataStores {
         };
 
         // Validate Access/Secret
-        if let Some(access_key) = datastore.get("access_key") {
+        if let Some(serde_json::Value::String(access_key)) = datastore.get("access_key") {
             if access_key == "" {
                 return Err(return_400("Access key cannot be empty."));
             }
             current_datastore.access_key = access_key.clone();
         }
-        if let Some(secret_key) = datastore.get("secret_key") {
+        if let Some(serde_json::Value::String(secret_key)) = datastore.get("secret_key") {
             if secret_key == "" {
                 return Err(return_400("Secret key cannot be empty."));
             }
             current_datastore.secret_key = secret_key.clone();
         }
         // Endpoint
-        if let Some(endpoint) = datastore.get("endpoint") {
+        if let Some(serde_json::Value::String(endpoint)) = datastore.get("endpoint") {
             if endpoint == "" {
                 return Err(return_400("Endpoint cannot be empty."));
             }
@@ -136,7 +151,7 @@ impl ApiDataStores {
         }
 
         // Bucket
-        if let Some(bucket) = datastore.get("bucket") {
+        if let Some(serde_json::Value::String(bucket)) = datastore.get("bucket") {
             if bucket == "" {
                 return Err(return_400("Bucket cannot be empty."));
             }
@@ -144,13 +159,50 @@ impl ApiDataStores {
         }
 
         // Prefix
-        if let Some(prefix) = datastore.get("prefix") {
+        if let Some(serde_json::Value::String(prefix)) = datastore.get("prefix") {
             current_datastore.prefix = prefix.clone();
         }
 
+        // Region, an empty value falls back to the default
+        if let Some(serde_json::Value::String(region)) = datastore.get("region") {
+            if region == "" {
+                current_datastore.region = None;
+            } else {
+                current_datastore.region = Some(region.clone());
+            }
+        }
+
+        // Server side encryption, an empty value turns it off
+        if let Some(serde_json::Value::String(sse)) = datastore.get("sse") {
+            if sse == "" {
+                current_datastore.sse = None;
+                current_datastore.sse_kms_key_id = None;
+            } else if !valid_sse(sse) {
+                return Err(return_400(
+                    "Server side encryption must be either `s3` or `kms`.",
+                ));
+            } else {
+                current_datastore.sse = Some(sse.clone());
+            }
+        }
+        if let Some(serde_json::Value::String(key_id)) = datastore.get("sse_kms_key_id") {
+            if key_id == "" {
+                current_datastore.sse_kms_key_id = None;
+            } else {
+                current_datastore.sse_kms_key_id = Some(key_id.clone());
+            }
+        }
+
+        // Bucket auto creation
+        if let Some(serde_json::Value::Bool(auto_create_bucket)) =
+            datastore.get("auto_create_bucket")
+        {
+            current_datastore.auto_create_bucket = *auto_create_bucket;
+        }
+
         // Validate name
         let mut datastore_name: Option<String> = None;
-        if let Some(name) = datastore.get("name") {
+        if let Some(serde_json::Value::String(name)) = datastore.get("name") {
             if name == "" {
                 return Err(return_400("Datastore name cannot be empty."));
             }
@@ -158,6 +210,11 @@ impl ApiDataStores {
             datastore_name = Some(name.clone());
         }
 
+        // Environment references must resolve, otherwise the datastore can't be loaded
+        if let Err(e) = current_datastore.clone().resolve_env_references() {
+            return Err(return_400(&e.to_string()));
+        }
+
         // if ds name changed, delete previous file
         if let Some(ds_name) = datastore_name {
             if ds_name != *pk {
@@ -173,12 +230,60 @@ impl ApiDataStores {
     }
 }
 
+/// Saves the datastore with `save`, creating its bucket with `create_bucket` first if it's flagged
+/// for `auto_create_bucket`. The datastore is not saved if its bucket couldn't be created.
+///
+/// `datastore` is in its stored form, only the bucket is created with its `${ENV_VAR}` references
+/// resolved.
+fn save_datastore<C, CF, S, SF>(
+    mut datastore: DataStore,
+    create_bucket: C,
+    save: S,
+) -> impl Future<Item = Response<Body>, Error = GenericError>
+where
+    C: FnOnce(&DataStore) -> CF,
+    CF: Future<Item = (), Error = StorageError<CreateBucketError>>,
+    S: FnOnce() -> SF,
+    SF: Future<Item = (), Error = String>,
+{
+    let bucket = if datastore.auto_create_bucket {
+        let mut resolved = datastore.clone();
+        match resolved.resolve_env_references() {
+            Ok(_) => Either::A(create_bucket(&resolved).map_err(|e| match e {
+                StorageError::Operation(CreateBucketError::Create(s)) => s,
+                _ => "Could not create bucket".to_string(),
+            })),
+            Err(e) => Either::B(future::err(e.to_string())),
+        }
+    } else {
+        Either::B(future::ok(()))
+    };
+    bucket.and_then(move |_| save()).then(move |v| match v {
+        Ok(_) => {
+            //remove sensitive data
+            datastore.safe();
+            let ds_serialized = serde_json::to_string(&datastore).unwrap();
+            let body = Body::from(Chunk::from(ds_serialized));
+            let mut response = Response::builder();
+            response.header(header::CONTENT_TYPE, "application/json");
+
+            future::ok(response.body(body).unwrap())
+        }
+        Err(e) => future::ok(return_500(&e)),
+    })
+}
+
+/// Whether `sse` is a supported server side encryption mode
+fn valid_sse(sse: &str) -> bool {
+    sse == "s3" || sse == "kms"
+}
+
 impl ViewSet for ApiDataStores {
     fn list(&self, req: Request<Body>) -> ResponseFuture {
         let cfg_read = self.config.read().unwrap();
         let mut datastores: Vec<DataStore> = Vec::new();
         for (_, ds) in &cfg_read.datastore {
-            datastores.push(ds.clone());
+            datastores.push(ds.to_stored());
         }
         // sort items
         datastores.sort_by(|a, b| a.name.cmp(&b.name));
@@ -196,32 +301,25 @@ impl ViewSet for ApiDataStores {
                 .from_err()
                 .and_then(move |entire_body| {
                     match ApiDataStores::parse_create_body(entire_body.to_vec(), cfg) {
-                        Ok(mut datastore) => {
+                        Ok(datastore) => {
                             // everything seems ok, create the datastore
                             let ds_serialized = serde_json::to_string(&datastore).unwrap();
                             let datastore_name = datastore.name.clone().unwrap();
 
                             let cfg = Arc::clone(&cfg2);
-                            let res = put_object_metabucket(
-                                cfg,
-                                format!("minsql/meta/datastores/{}", datastore_name),
-                                ds_serialized,
-                            )
-                            .map_err(|_| ())
-                            .then(move |v| match v {
-                                Ok(_) => {
-                                    datastore.safe();
-                                    let ds_serialized = serde_json::to_string(&datastore).unwrap();
-
-                                    let body = Body::from(Chunk::from(ds_serialized));
-                                    let mut response = Response::builder();
-                                    response.header(header::CONTENT_TYPE, "application/json");
-
-                                    future::ok(response.body(body).unwrap())
-                                }
-                                Err(_) => future::ok(return_500("error saving datastore")),
-                            });
-                            Either::A(res)
+                            Either::A(save_datastore(
+                                datastore,
+                                create_datastore_bucket,
+                                move || {
+                                    put_object_metabucket(
+                                        cfg,
+                                        format!("minsql/meta/datastores/{}", datastore_name),
+                                        ds_serialized,
+                                    )
+                                    .map(|_| ())
+                                    .map_err(|_| "error saving datastore".to_string())
+                                },
+                            ))
                         }
                         Err(e) => Either::B(future::ok(e)),
                     }
@@ -232,7 +330,7 @@ impl ViewSet for ApiDataStores {
     fn retrieve(&self, _req: Request<Body>, pk: &str) -> ResponseFuture {
         let cfg_read = self.config.read().unwrap();
         let mut datastore = match cfg_read.datastore.get(pk) {
-            Some(ds) => ds.clone(),
+            Some(ds) => ds.to_stored(),
             None => {
                 return Box::new(future::ok(return_404()));
             }
@@ -252,32 +350,23 @@ impl ViewSet for ApiDataStores {
                 .from_err()
                 .and_then(move |entire_body| {
                     match ApiDataStores::parse_update_body(entire_body.to_vec(), cfg, &pk) {
-                        Ok(mut current_datastore) => {
+                        Ok(current_datastore) => {
                             // everything seems ok, write to datastore
                             let ds_serialized = serde_json::to_string(&current_datastore).unwrap();
 
-                            let res = put_object_metabucket(
-                                cfg2,
-                                format!("minsql/meta/datastores/{}", pk),
-                                ds_serialized.clone(),
-                            )
-                            .map_err(|_| {})
-                            .then(move |v| match v {
-                                Ok(_) => {
-                                    //remove sensitive data
-                                    current_datastore.safe();
-                                    let ds_serialized =
-                                        serde_json::to_string(&current_datastore).unwrap();
-                                    let body = Body::from(Chunk::from(ds_serialized));
-                                    let mut response = Response::builder();
-                                    response.header(header::CONTENT_TYPE, "application/json");
-
-                                    future::ok(response.body(body).unwrap())
-                                }
-                                Err(_) => future::ok(return_500("error saving datastore")),
-                            });
-
-                            Either::A(res)
+                            Either::A(save_datastore(
+                                current_datastore,
+                                create_datastore_bucket,
+                                move || {
+                                    put_object_metabucket(
+                                        cfg2,
+                                        format!("minsql/meta/datastores/{}", pk),
+                                        ds_serialized,
+                                    )
+                                    .map(|_| ())
+                                    .map_err(|_| "error saving datastore".to_string())
+                                },
+                            ))
                         }
                         Err(e) => Either::B(future::ok(e)),
                     }
@@ -288,7 +377,7 @@ impl ViewSet for ApiDataStores {
     fn delete(&self, _req: Request<Body>, pk: &str) -> ResponseFuture {
         let read_cfg = self.config.read().unwrap();
         let mut datastore = match read_cfg.datastore.get(pk) {
-            Some(v) => v.clone(),
+            Some(v) => v.to_stored(),
             None => {
                 return Box::new(future::ok(return_404()));
             }
@@ -319,3 +408,193 @@ impl ViewSet for ApiDataStores {
         )
     }
 }
+
+#[cfg(test)]
+mod datastores_tests {
+    use std::env;
+
+    use hyper::StatusCode;
+    use rusoto_core::RusotoError;
+
+    use crate::config::Server;
+    use crate::storage::create_bucket_with;
+
+    use super::*;
+
+    fn datastore_for(name: &str, auto_create_bucket: bool) -> DataStore {
+        DataStore {
+            name: Some(name.to_string()),
+            endpoint: "http://localhost:9000".to_string(),
+            access_key: "minio".to_string(),
+            secret_key: "minio123".to_string(),
+            bucket: "mybucket".to_string(),
+            prefix: "".to_string(),
+            region: None,
+            sse: None,
+            sse_kms_key_id: None,
+            auto_create_bucket: auto_create_bucket,
+            stored: None,
+        }
+    }
+
+    #[test]
+    fn save_datastore_creates_bucket() {
+        let mut created: Vec<String> = Vec::new();
+        let mut saved = false;
+        let response = save_datastore(
+            datastore_for("ds1", true),
+            |ds| {
+                created.push(ds.bucket.clone());
+                future::ok(())
+            },
+            || {
+                saved = true;
+                future::ok(())
+            },
+        )
+        .wait()
+        .unwrap();
+
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(created, vec!["mybucket".to_string()]);
+        assert!(saved);
+    }
+
+    #[test]
+    fn save_datastore_without_auto_create_bucket() {
+        let mut created = false;
+        let mut saved = false;
+        let response = save_datastore(
+            datastore_for("ds1", false),
+            |_| {
+                created = true;
+                future::ok(())
+            },
+            || {
+                saved = true;
+                future::ok(())
+            },
+        )
+        .wait()
+        .unwrap();
+
+        assert_eq!(response.status(), StatusCode::OK);
+        assert!(!created);
+        assert!(saved);
+    }
+
+    #[test]
+    fn save_datastore_with_bucket_already_owned() {
+        let mut saved = false;
+        let response = save_datastore(
+            datastore_for("ds1", true),
+            |ds| {
+                create_bucket_with(ds, |_| {
+                    future::err(RusotoError::Service(
+                        rusoto_s3::CreateBucketError::BucketAlreadyOwnedByYou("".to_string()),
+                    ))
+                })
+            },
+            || {
+                saved = true;
+                future::ok(())
+            },
+        )
+        .wait()
+        .unwrap();
+
+        assert_eq!(response.status(), StatusCode::OK);
+        assert!(saved);
+    }
+
+    #[test]
+    fn save_datastore_bucket_creation_failed() {
+        let mut saved = false;
+        let response = save_datastore(
+            datastore_for("ds1", true),
+            |_| {
+                future::err(StorageError::Operation(CreateBucketError::Create(
+                    "Could not create bucket: Access Denied".to_string(),
+                )))
+            },
+            || {
+                saved = true;
+                future::ok(())
+            },
+        )
+        .wait()
+        .unwrap();
+
+        assert_eq!(response.status(), StatusCode::INTERNAL_SERVER_ERROR);
+        assert!(!saved);
+    }
+
+    #[test]
+    fn save_datastore_creates_bucket_with_resolved_references() {
+        env::set_var("MINSQL_TEST_API_DS_ACCESS", "minio");
+        let mut datastore = datastore_for("ds1", true);
+        datastore.access_key = "${MINSQL_TEST_API_DS_ACCESS}".to_string();
+
+        let mut created: Vec<String> = Vec::new();
+        let response = save_datastore(
+            datastore,
+            |ds| {
+                created.push(ds.access_key.clone());
+                future::ok(())
+            },
+            || future::ok(()),
+        )
+        .wait()
+        .unwrap();
+
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(created, vec!["minio".to_string()]);
+        let body = response.into_body().concat2().wait().unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["access_key"], "${MINSQL_TEST_API_DS_ACCESS}");
+    }
+
+    fn config_with_resolved_datastore(secret_key: &str) -> Arc<RwLock<Config>> {
+        let mut datastore = datastore_for("ds1", false);
+        datastore.secret_key = secret_key.to_string();
+        datastore.resolve_env_references().unwrap();
+        let mut cfg = Config::new(Server::default());
+        cfg.datastore.insert("ds1".to_string(), datastore);
+        Arc::new(RwLock::new(cfg))
+    }
+
+    #[test]
+    fn update_keeps_env_references() {
+        env::set_var("MINSQL_TEST_API_DS_SECRET", "minio123");
+        let cfg = config_with_resolved_datastore("${MINSQL_TEST_API_DS_SECRET}");
+        assert_eq!(cfg.read().unwrap().datastore["ds1"].secret_key, "minio123");
+
+        let updated = ApiDataStores::parse_update_body(
+            br#"{"bucket": "otherbucket"}"#.to_vec(),
+            cfg,
+            &"ds1".to_string(),
+        )
+        .unwrap();
+
+        assert_eq!(updated.bucket, "otherbucket");
+        assert_eq!(updated.secret_key, "${MINSQL_TEST_API_DS_SECRET}");
+        let persisted = serde_json::to_string(&updated).unwrap();
+        assert!(persisted.contains("${MINSQL_TEST_API_DS_SECRET}"));
+        assert!(!persisted.contains("minio123"));
+    }
+
+    #[test]
+    fn update_with_unset_env_reference() {
+        env::remove_var("MINSQL_TEST_API_DS_UNSET");
+        let cfg = config_with_resolved_datastore("minio123");
+
+        match ApiDataStores::parse_update_body(
+            br#"{"secret_key": "${MINSQL_TEST_API_DS_UNSET}"}"#.to_vec(),
+            cfg,
+            &"ds1".to_string(),
+        ) {
+            Ok(_) => panic!("Update referencing an unset variable should have failed"),
+            Err(resp) => assert_eq!(resp.status(), StatusCode::BAD_REQUEST),
+        }
+    }
+}
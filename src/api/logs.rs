@@ -68,6 +68,9 @@ impl ApiLogs {
 
         let cfg_read = cfg.read().unwrap();
         // validate the datastores
+        if log.datastores.is_empty() {
+            return Err(return_400("A log needs at least one datastore."));
+        }
         for ds_name in &log.datastores {
             if cfg_read.datastore.contains_key(ds_name) == false {
                 return Err(return_400(&format!(
@@ -147,6 +150,9 @@ impl ApiLogs {
                     }
                 }
             }
+            if datastores.is_empty() {
+                return Err(return_400("A log needs at least one datastore."));
+            }
             current_log.datastores = datastores;
         }
 
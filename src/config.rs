@@ -22,7 +22,9 @@ use clap::{App, Arg};
 use log::error;
 use serde_derive::{Deserialize, Serialize};
 
-use crate::constants::DEFAULT_SERVER_ADDRESS;
+use crate::constants::{
+    DEFAULT_MAX_CONCURRENT_INGESTS, DEFAULT_MAX_QUERY_BYTES, DEFAULT_SERVER_ADDRESS,
+};
 
 // environment variables
 pub const METABUCKET_ENDPOINT: &str = "MINSQL_METABUCKET_ENDPOINT";
@@ -56,6 +58,12 @@ pub struct Server {
     pub secret_key: String,
     pub pkcs12_cert: Option<String>,
     pub pkcs12_password: Option<String>,
+    // Largest search query body accepted, in bytes
+    pub max_query_bytes: usize,
+    // Don't serve the web UI, for API only deployments
+    pub disable_webui: bool,
+    // Most log stores processed at once, 0 for no limit
+    pub max_concurrent_ingests: usize,
 }
 
 #[derive(Serialize, Deserialize, Clone, PartialEq, Debug)]
@@ -66,6 +74,81 @@ pub struct DataStore {
     pub secret_key: String,
     pub bucket: String,
     pub prefix: String,
+    // Region used to sign requests, needed for AWS S3 buckets outside the default region
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub region: Option<String>,
+    // Server side encryption for the objects written, either `s3` or `kms`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sse: Option<String>,
+    // Key used when `sse` is `kms`, if absent the default key of the datastore is used
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sse_kms_key_id: Option<String>,
+    // Create the bucket when the datastore is saved if it doesn't exist yet
+    #[serde(default = "def_false")]
+    pub auto_create_bucket: bool,
+    // The datastore as stored in the metabucket, kept once `${ENV_VAR}` references are resolved
+    #[serde(skip)]
+    pub stored: Option<Box<DataStore>>,
+}
+
+impl DataStore {
+    /// Replaces `${ENV_VAR}` references in the string fields of the datastore with
+    /// the value of the variable in the process environment, so secrets don't need
+    /// to be stored in the metabucket.
+    pub fn resolve_env_references(&mut self) -> Result<(), ConfigurationError> {
+        let stored = self.to_stored();
+        self.endpoint = substitute_env_vars(&self.endpoint)?;
+        self.access_key = substitute_env_vars(&self.access_key)?;
+        self.secret_key = substitute_env_vars(&self.secret_key)?;
+        self.bucket = substitute_env_vars(&self.bucket)?;
+        self.prefix = substitute_env_vars(&self.prefix)?;
+        if let Some(region) = &self.region {
+            self.region = Some(substitute_env_vars(region)?);
+        }
+        if let Some(key_id) = &self.sse_kms_key_id {
+            self.sse_kms_key_id = Some(substitute_env_vars(key_id)?);
+        }
+        self.stored = Some(Box::new(stored));
+        Ok(())
+    }
+
+    /// Returns the datastore as stored in the metabucket, with its `${ENV_VAR}` references
+    /// unresolved. This is the form to save or show, never the resolved one.
+    pub fn to_stored(&self) -> DataStore {
+        match &self.stored {
+            Some(stored) => (**stored).clone(),
+            None => self.clone(),
+        }
+    }
+}
+
+/// Expands every `${ENV_VAR}` found in `value`, failing if a referenced variable is not set.
+/// A `${` without a closing brace is kept as is.
+fn substitute_env_vars(value: &str) -> Result<String, ConfigurationError> {
+    let mut result = String::with_capacity(value.len());
+    let mut rest = value;
+    while let Some(start) = rest.find("${") {
+        let end = match rest[start + 2..].find('}') {
+            Some(end) => start + 2 + end,
+            None => break,
+        };
+        let var_name = &rest[start + 2..end];
+        match env::var(var_name) {
+            Ok(val) => {
+                result.push_str(&rest[..start]);
+                result.push_str(&val);
+            }
+            Err(e) => {
+                return Err(ConfigurationError::new(&format!(
+                    "Environment variable `{}` referenced in configuration is not set. {}",
+                    var_name, e
+                )));
+            }
+        }
+        rest = &rest[end + 1..];
+    }
+    result.push_str(rest);
+    Ok(result)
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
@@ -75,6 +158,19 @@ pub struct Log {
     pub commit_window: String,
 }
 
+impl Log {
+    /// Checks the log can be used, a log without datastores has nowhere to write or read from.
+    pub fn validate(&self) -> Result<(), ConfigurationError> {
+        if self.datastores.is_empty() {
+            return Err(ConfigurationError::new(&format!(
+                "Log `{}` has no datastores",
+                self.name.clone().unwrap_or_default()
+            )));
+        }
+        Ok(())
+    }
+}
+
 // To circumvent serde(default=false) limitation https://github.com/serde-rs/serde/issues/1030
 fn def_true() -> bool {
     true
@@ -186,11 +282,64 @@ pub fn load_configuration() -> Result<Config, ConfigurationError> {
                 .help("Server binding address, i.e.: 0.0.0.0:9000")
                 .required(true),
         )
+        .arg(
+            Arg::with_name("max_query_bytes")
+                .takes_value(true)
+                .default_value(DEFAULT_MAX_QUERY_BYTES)
+                .long("max-query-bytes")
+                .help("Maximum size in bytes of a search query, i.e.: 10485760"),
+        )
+        .arg(
+            Arg::with_name("max_concurrent_ingests")
+                .takes_value(true)
+                .default_value(DEFAULT_MAX_CONCURRENT_INGESTS)
+                .long("max-concurrent-ingests")
+                .help("Maximum number of log stores processed at once, 0 for no limit"),
+        )
+        .arg(
+            Arg::with_name("disable_webui")
+                .long("disable-webui")
+                .help("Don't serve the web UI under /ui"),
+        )
         .get_matches();
 
     // Server address, safe to unwrap since it has a default value.
     let address = matches.value_of("address").unwrap().to_string();
 
+    // Maximum query size, safe to unwrap since it has a default value.
+    let max_query_bytes = match matches
+        .value_of("max_query_bytes")
+        .unwrap()
+        .parse::<usize>()
+    {
+        Ok(val) => val,
+        Err(e) => {
+            return Err(ConfigurationError::new(&format!(
+                "Invalid maximum query size `{}`. {}",
+                matches.value_of("max_query_bytes").unwrap(),
+                e
+            )));
+        }
+    };
+
+    // Maximum concurrent ingests, safe to unwrap since it has a default value.
+    let max_concurrent_ingests = match matches
+        .value_of("max_concurrent_ingests")
+        .unwrap()
+        .parse::<usize>()
+    {
+        Ok(val) => val,
+        Err(e) => {
+            return Err(ConfigurationError::new(&format!(
+                "Invalid maximum concurrent ingests `{}`. {}",
+                matches.value_of("max_concurrent_ingests").unwrap(),
+                e
+            )));
+        }
+    };
+
+    let disable_webui = matches.is_present("disable_webui");
+
     // Check for configuration on the environment, else return error.
 
     let metadata_endpoint: String = match env::var(METABUCKET_ENDPOINT) {
@@ -253,6 +402,9 @@ pub fn load_configuration() -> Result<Config, ConfigurationError> {
         secret_key,
         pkcs12_cert,
         pkcs12_password,
+        max_query_bytes,
+        disable_webui,
+        max_concurrent_ingests,
     };
 
     let mut configuration = Config::new(server);
@@ -294,7 +446,9 @@ pub fn load_configuration() -> Result<Config, ConfigurationError> {
 
 #[cfg(test)]
 mod config_tests {
-    use crate::config::Config;
+    use std::env;
+
+    use crate::config::{Config, DataStore, Log};
 
     #[test]
     fn parse_interval() {
@@ -316,4 +470,87 @@ mod config_tests {
             None
         );
     }
+
+    fn datastore_with_secret(secret_key: &str) -> DataStore {
+        DataStore {
+            name: Some("ds1".to_owned()),
+            endpoint: "http://localhost:9000".to_owned(),
+            access_key: "minio".to_owned(),
+            secret_key: secret_key.to_owned(),
+            bucket: "logs".to_owned(),
+            prefix: "".to_owned(),
+            region: None,
+            sse: None,
+            sse_kms_key_id: None,
+            auto_create_bucket: false,
+            stored: None,
+        }
+    }
+
+    #[test]
+    fn resolve_env_reference() {
+        env::set_var("MINSQL_TEST_DS_SECRET", "minio123");
+        let mut ds = datastore_with_secret("${MINSQL_TEST_DS_SECRET}");
+        assert!(ds.resolve_env_references().is_ok());
+        assert_eq!(ds.secret_key, "minio123");
+        assert_eq!(ds.access_key, "minio");
+    }
+
+    #[test]
+    fn resolved_datastore_keeps_stored_form() {
+        env::set_var("MINSQL_TEST_DS_STORED", "minio123");
+        let mut ds = datastore_with_secret("${MINSQL_TEST_DS_STORED}");
+        assert_eq!(ds.to_stored(), ds);
+        assert!(ds.resolve_env_references().is_ok());
+        // resolving again doesn't lose the references
+        assert!(ds.resolve_env_references().is_ok());
+        assert_eq!(ds.secret_key, "minio123");
+        assert_eq!(
+            ds.to_stored(),
+            datastore_with_secret("${MINSQL_TEST_DS_STORED}")
+        );
+        assert!(!serde_json::to_string(&ds).unwrap().contains("stored"));
+    }
+
+    #[test]
+    fn resolve_env_reference_inside_value() {
+        env::set_var("MINSQL_TEST_DS_SUFFIX", "123");
+        let mut ds =
+            datastore_with_secret("minio${MINSQL_TEST_DS_SUFFIX}-${MINSQL_TEST_DS_SUFFIX}");
+        assert!(ds.resolve_env_references().is_ok());
+        assert_eq!(ds.secret_key, "minio123-123");
+    }
+
+    #[test]
+    fn resolve_missing_env_reference() {
+        env::remove_var("MINSQL_TEST_DS_MISSING");
+        let mut ds = datastore_with_secret("${MINSQL_TEST_DS_MISSING}");
+        match ds.resolve_env_references() {
+            Ok(_) => panic!("expected missing variable error"),
+            Err(e) => assert!(format!("{}", e).contains("MINSQL_TEST_DS_MISSING")),
+        }
+    }
+
+    #[test]
+    fn log_without_datastores() {
+        let log = Log {
+            name: Some("mylog".to_owned()),
+            datastores: Vec::new(),
+            commit_window: "5s".to_owned(),
+        };
+        match log.validate() {
+            Ok(_) => panic!("expected a log without datastores to be invalid"),
+            Err(e) => assert_eq!(format!("{}", e), "Log `mylog` has no datastores"),
+        }
+    }
+
+    #[test]
+    fn log_with_datastores() {
+        let log = Log {
+            name: Some("mylog".to_owned()),
+            datastores: vec!["ds1".to_owned()],
+            commit_window: "5s".to_owned(),
+        };
+        assert!(log.validate().is_ok());
+    }
 }
@@ -16,6 +16,8 @@
 
 // Server Defaults
 pub const DEFAULT_SERVER_ADDRESS: &str = "0.0.0.0:9999";
+pub const DEFAULT_MAX_QUERY_BYTES: &str = "10485760";
+pub const DEFAULT_MAX_CONCURRENT_INGESTS: &str = "0";
 
 // Smart Fields
 pub const SF_IP: &str = "$ip";
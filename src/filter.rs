@@ -310,6 +310,9 @@ mod filter_tests {
                 secret_key: "".to_string(),
                 pkcs12_cert: None,
                 pkcs12_password: None,
+                max_query_bytes: 10485760,
+                disable_webui: false,
+                max_concurrent_ingests: 0,
             },
             datastore: HashMap::new(),
             tokens: HashMap::new(),
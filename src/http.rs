@@ -17,9 +17,11 @@
 use std::collections::HashMap;
 use std::ffi::OsStr;
 use std::path::Path;
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::{Arc, Mutex, RwLock};
 
 use futures::{future, Future};
+use hyper::header::{HeaderValue, RETRY_AFTER};
 use hyper::{Body, Method, Request, Response, StatusCode};
 use log::info;
 use serde_derive::Serialize;
@@ -28,7 +30,7 @@ use crate::api::Api;
 use crate::auth::Auth;
 use crate::config::Config;
 use crate::constants::{APP_JAVASCRIPT, APP_JSON, IMAGE_JPEG, TEXT_HTML, UNKNOWN_CONTENT_TYPE};
-use crate::ingest::{Ingest, IngestBuffer};
+use crate::ingest::{Ingest, IngestBuffer, IngestCounters};
 use crate::query::Query;
 
 pub type GenericError = Box<dyn std::error::Error + Send + Sync>;
@@ -37,6 +39,8 @@ pub type ResponseFuture = Box<Future<Item = Response<Body>, Error = GenericError
 static INDEX_BODY: &[u8] = b"MinSQL";
 static NOTFOUND_BODY: &str = "Not Found";
 static UNAUTHORIZED_BODY: &str = "Unauthorized";
+// Seconds a client should wait before retrying a rejected log store
+static INGEST_RETRY_AFTER: &str = "1";
 
 pub struct Http {
     config: Arc<RwLock<Config>>,
@@ -51,6 +55,8 @@ impl Http {
         &self,
         req: Request<Body>,
         log_ingest_buffers: Arc<HashMap<String, Mutex<IngestBuffer>>>,
+        ingests_in_flight: Arc<AtomicUsize>,
+        ingest_counters: Arc<IngestCounters>,
     ) -> ResponseFuture {
         let cfg = self.config.read().unwrap();
 
@@ -60,7 +66,13 @@ impl Http {
 
         match (req.method(), req.uri().path(), parts.get(0)) {
             // delegate anything starting with /api/ to the api router
-            (_, _, Some(&"ui")) => serve_static_content(req),
+            (_, _, Some(&"ui")) => {
+                if cfg.server.disable_webui {
+                    Box::new(future::ok(return_404()))
+                } else {
+                    serve_static_content(req)
+                }
+            }
             (_, _, Some(&"api")) => {
                 let api = Api::new(Arc::clone(&self.config));
                 api.router(req, parts)
@@ -70,14 +82,27 @@ impl Http {
                 Box::new(future::ok(Response::new(body)))
             }
 
-            (&Method::POST, "/search", _) => match self.extract_auth_token(&req) {
-                Ok(tok) => {
-                    let cfg = Arc::clone(&self.config);
-                    let query_c = Query::new(cfg);
-                    query_c.api_log_search(req, &tok)
+            (&Method::GET, "/version", _) => Box::new(future::ok(return_version())),
+
+            (&Method::POST, "/search", _) | (&Method::GET, "/search", _) => {
+                match self.extract_auth_token(&req) {
+                    Ok(tok) => {
+                        let cfg = Arc::clone(&self.config);
+                        let query_c = Query::new(cfg);
+                        query_c.api_log_search(req, &tok)
+                    }
+                    Err(err_resp) => err_resp,
                 }
-                Err(err_resp) => err_resp,
-            },
+            }
+
+            // only the store endpoint of a log answers HEAD
+            (&Method::HEAD, _pth, _) if self.requested_log_from_request(&req).is_some() => {
+                Box::new(future::ok(self.check_log_store(&req)))
+            }
+
+            (&Method::GET, _pth, _) if requested_log_for(&req, "stats").is_some() => {
+                Box::new(future::ok(self.log_stats(&req, &ingest_counters)))
+            }
 
             (&Method::PUT, _pth, _) => {
                 match self.requested_log_from_request(&req) {
@@ -95,13 +120,33 @@ impl Http {
                         };
 
                         // Does the provided token have access to this log?
-                        let cfg = Arc::clone(&self.config);
-                        let auth_c = Auth::new(cfg);
+                        let cfg_arc = Arc::clone(&self.config);
+                        let auth_c = Auth::new(cfg_arc);
                         if !auth_c.token_has_access_to_log(&access_token, &name) {
                             return Box::new(future::ok(return_401()));
                         }
+                        // Is there room for one more ingest?
+                        let in_flight = match InFlightIngest::start(
+                            ingests_in_flight,
+                            cfg.server.max_concurrent_ingests,
+                        ) {
+                            Some(in_flight) => in_flight,
+                            None => {
+                                return Box::new(future::ok(return_503(
+                                    "Too many concurrent log stores",
+                                )));
+                            }
+                        };
                         let ingest_c = Ingest::new(Arc::clone(&self.config));
-                        ingest_c.api_log_store(req, log_ingest_buffers, name)
+                        Box::new(
+                            ingest_c
+                                .api_log_store(req, log_ingest_buffers, ingest_counters, name)
+                                .then(move |res| {
+                                    // the ingest is done
+                                    drop(in_flight);
+                                    res
+                                }),
+                        )
                     }
                 }
             }
@@ -145,70 +190,211 @@ impl Http {
         }
     }
 
+    /// Answers a `HEAD` on the store endpoint of a log, letting clients verify the log exists and
+    /// that they can write to it before sending any data.
+    pub fn check_log_store(&self, req: &Request<Body>) -> Response<Body> {
+        let name = match self.requested_log_from_request(req) {
+            Some(name) => name,
+            None => return return_404(),
+        };
+        if let Err(err_resp) = self.authorize_log_request(req, &name) {
+            return err_resp;
+        }
+        Response::builder()
+            .status(StatusCode::OK)
+            .body(Body::empty())
+            .unwrap()
+    }
+
+    /// Answers a `GET` on the stats endpoint of a log with the records and bytes stored into it
+    /// since the server started.
+    pub fn log_stats(
+        &self,
+        req: &Request<Body>,
+        ingest_counters: &IngestCounters,
+    ) -> Response<Body> {
+        let name = match requested_log_for(req, "stats") {
+            Some(name) => name,
+            None => return return_404(),
+        };
+        if let Err(err_resp) = self.authorize_log_request(req, &name) {
+            return err_resp;
+        }
+        let (records, bytes) = ingest_counters.totals(&name);
+        let obj = LogStatsResponse {
+            log: name,
+            records,
+            bytes,
+        };
+        let output = serde_json::to_string(&obj).unwrap();
+        Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", APP_JSON)
+            .body(Body::from(output))
+            .unwrap()
+    }
+
+    /// Checks the log exists and that the token of the request has access to it.
+    fn authorize_log_request(
+        &self,
+        req: &Request<Body>,
+        name: &String,
+    ) -> Result<(), Response<Body>> {
+        // Does log exist in config?
+        if self.config.read().unwrap().get_log(name).is_none() {
+            return Err(return_404());
+        }
+        let access_token = match self.validate_token_from_header(req) {
+            HeaderToken::NoToken => return Err(return_401()),
+            HeaderToken::InvalidToken => return Err(return_400("Invalid token")),
+            HeaderToken::Token(tok) => tok,
+        };
+        // Does the provided token have access to this log?
+        let auth_c = Auth::new(Arc::clone(&self.config));
+        if !auth_c.token_has_access_to_log(&access_token, name) {
+            return Err(return_401());
+        }
+        Ok(())
+    }
+
     pub fn requested_log_from_request(&self, req: &Request<Body>) -> Option<String> {
-        let request_path_no_slash = String::from(&req.uri().path()[1..]);
-        let path_split = request_path_no_slash.split("/");
-        let parts: Vec<&str> = path_split.collect();
-        if parts.len() != 2 {
+        requested_log_for(req, "store")
+    }
+}
+
+/// Returns the name of the log of a request to the given endpoint of a log, `/<log>/<endpoint>`.
+fn requested_log_for(req: &Request<Body>, endpoint: &str) -> Option<String> {
+    let request_path_no_slash = String::from(&req.uri().path()[1..]);
+    let path_split = request_path_no_slash.split("/");
+    let parts: Vec<&str> = path_split.collect();
+    if parts.len() != 2 {
+        None
+    } else {
+        let logname = parts[0].to_string();
+        let method = parts[1].to_string();
+        if method != endpoint {
             None
         } else {
-            let logname = parts[0].to_string();
-            let method = parts[1].to_string();
-            if method != "store" {
-                None
-            } else {
-                Some(logname)
-            }
+            Some(logname)
+        }
+    }
+}
+
+/// Counts a log store in flight for as long as it's alive.
+struct InFlightIngest {
+    ingests_in_flight: Arc<AtomicUsize>,
+}
+
+impl InFlightIngest {
+    /// Counts a new ingest, returns `None` if `max_concurrent_ingests` are already in flight. A
+    /// limit of 0 means there's no limit.
+    fn start(
+        ingests_in_flight: Arc<AtomicUsize>,
+        max_concurrent_ingests: usize,
+    ) -> Option<InFlightIngest> {
+        let previous = ingests_in_flight.fetch_add(1, Ordering::SeqCst);
+        let in_flight = InFlightIngest { ingests_in_flight };
+        if max_concurrent_ingests > 0 && previous >= max_concurrent_ingests {
+            // dropping it discounts it
+            None
+        } else {
+            Some(in_flight)
         }
     }
 }
 
+impl Drop for InFlightIngest {
+    fn drop(&mut self) {
+        self.ingests_in_flight.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+/// Data stored into a log since the server started.
+#[derive(Debug, Serialize)]
+struct LogStatsResponse {
+    log: String,
+    records: usize,
+    bytes: usize,
+}
+
 #[derive(Debug, Serialize)]
 struct ErrorResponse {
-    message: String,
+    error: String,
+    code: u16,
 }
 
-pub fn return_500(message: &str) -> Response<Body> {
-    Response::builder()
-        .status(StatusCode::INTERNAL_SERVER_ERROR)
-        .body(Body::from(message.to_string()))
-        .unwrap()
+/// Build information of the running server, the commit and build time are only present if the
+/// `MINSQL_COMMIT_ID` and `MINSQL_BUILD_TIME` environment variables were set at compile time.
+#[derive(Debug, Serialize)]
+struct VersionResponse {
+    version: &'static str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    commit: Option<&'static str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    build_time: Option<&'static str>,
 }
 
-pub fn return_404() -> Response<Body> {
-    let obj = ErrorResponse {
-        message: NOTFOUND_BODY.to_string(),
+pub fn return_version() -> Response<Body> {
+    let obj = VersionResponse {
+        version: env!("CARGO_PKG_VERSION"),
+        commit: option_env!("MINSQL_COMMIT_ID"),
+        build_time: option_env!("MINSQL_BUILD_TIME"),
     };
     let output = serde_json::to_string(&obj).unwrap();
-    let body = Body::from(output);
     Response::builder()
-        .status(StatusCode::NOT_FOUND)
-        .body(body)
+        .status(StatusCode::OK)
+        .header("Content-Type", APP_JSON)
+        .body(Body::from(output))
         .unwrap()
 }
 
-pub fn return_401() -> Response<Body> {
+/// Builds an error response with a JSON body holding the `message` as `error` and the status
+/// `code`.
+pub fn return_error(status: StatusCode, message: &str) -> Response<Body> {
     let obj = ErrorResponse {
-        message: UNAUTHORIZED_BODY.to_string(),
+        error: message.to_string(),
+        code: status.as_u16(),
     };
     let output = serde_json::to_string(&obj).unwrap();
-    let body = Body::from(output);
     Response::builder()
-        .status(StatusCode::UNAUTHORIZED)
-        .body(body)
+        .status(status)
+        .header("Content-Type", APP_JSON)
+        .body(Body::from(output))
         .unwrap()
 }
 
+pub fn return_500(message: &str) -> Response<Body> {
+    return_error(StatusCode::INTERNAL_SERVER_ERROR, message)
+}
+
+pub fn return_404() -> Response<Body> {
+    return_error(StatusCode::NOT_FOUND, NOTFOUND_BODY)
+}
+
+pub fn return_401() -> Response<Body> {
+    return_error(StatusCode::UNAUTHORIZED, UNAUTHORIZED_BODY)
+}
+
 pub fn return_400(message: &str) -> Response<Body> {
-    let obj = ErrorResponse {
-        message: format!("Bad request: {}", &message),
-    };
-    let output = serde_json::to_string(&obj).unwrap();
-    let body = Body::from(output);
-    Response::builder()
-        .status(StatusCode::BAD_REQUEST)
-        .body(body)
-        .unwrap()
+    return_error(
+        StatusCode::BAD_REQUEST,
+        &format!("Bad request: {}", &message),
+    )
+}
+
+pub fn return_503(message: &str) -> Response<Body> {
+    let mut response = return_error(StatusCode::SERVICE_UNAVAILABLE, message);
+    response
+        .headers_mut()
+        .insert(RETRY_AFTER, HeaderValue::from_static(INGEST_RETRY_AFTER));
+    response
+}
+
+pub fn return_413(message: &str) -> Response<Body> {
+    return_error(
+        StatusCode::PAYLOAD_TOO_LARGE,
+        &format!("Payload too large: {}", &message),
+    )
 }
 
 /// Represents the presence of a token in the header and whether it can be read as valid ASCII.
@@ -286,7 +472,9 @@ fn serve_static_content(req: Request<Body>) -> ResponseFuture {
 
 #[cfg(test)]
 mod http_tests {
-    use crate::config::{Config, LogAuth, Server, Token};
+    use futures::Stream;
+
+    use crate::config::{Config, Log, LogAuth, Server, Token};
 
     use super::*;
 
@@ -330,6 +518,9 @@ mod http_tests {
                 secret_key: "".to_string(),
                 pkcs12_cert: None,
                 pkcs12_password: None,
+                max_query_bytes: 10485760,
+                disable_webui: false,
+                max_concurrent_ingests: 0,
             },
             datastore: HashMap::new(),
             tokens: tokens,
@@ -407,4 +598,284 @@ mod http_tests {
             expected_token: Some("TOKEN2".to_string()),
         })
     }
+
+    fn run_test_check_log_store(path: &str, token: Option<&str>) -> StatusCode {
+        let mut cfg = get_auth_config_for(VALID_TOKEN.to_string(), "mylog".to_string());
+        cfg.log.insert(
+            "mylog".to_string(),
+            Log {
+                name: Some("mylog".to_string()),
+                datastores: Vec::new(),
+                commit_window: "5s".to_string(),
+            },
+        );
+        let http_c = Http::new(Arc::new(RwLock::new(cfg)));
+
+        let mut req = Request::builder();
+        req.method("HEAD").uri(path);
+        if let Some(tok) = token {
+            req.header("MINSQL-TOKEN", tok);
+        }
+        let req = req.body(Body::empty()).unwrap();
+
+        http_c
+            .request_router(
+                req,
+                Arc::new(HashMap::new()),
+                Arc::new(AtomicUsize::new(0)),
+                Arc::new(IngestCounters::new()),
+            )
+            .wait()
+            .unwrap()
+            .status()
+    }
+
+    #[test]
+    fn head_existing_log() {
+        let status = run_test_check_log_store("/mylog/store", Some(VALID_TOKEN));
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test]
+    fn head_missing_log() {
+        let status = run_test_check_log_store("/otherlog/store", Some(VALID_TOKEN));
+        assert_eq!(status, StatusCode::NOT_FOUND);
+    }
+
+    #[test]
+    fn head_existing_log_without_token() {
+        let status = run_test_check_log_store("/mylog/store", None);
+        assert_eq!(status, StatusCode::UNAUTHORIZED);
+    }
+
+    #[test]
+    fn head_outside_log_store() {
+        // anything else falls through to the regular routing
+        let status = run_test_check_log_store("/mylog", None);
+        assert_eq!(status, StatusCode::NOT_FOUND);
+        let status = run_test_check_log_store("/search", None);
+        assert_eq!(status, StatusCode::NOT_FOUND);
+    }
+
+    #[test]
+    fn version_payload() {
+        let resp = return_version();
+        assert_eq!(resp.status(), StatusCode::OK);
+        let body = resp.into_body().concat2().wait().unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["version"], env!("CARGO_PKG_VERSION"));
+    }
+
+    fn run_test_request_router(disable_webui: bool, path: &str) -> StatusCode {
+        let mut cfg = get_auth_config_for(VALID_TOKEN.to_string(), "mylog".to_string());
+        cfg.server.disable_webui = disable_webui;
+        let http_c = Http::new(Arc::new(RwLock::new(cfg)));
+        let req = Request::builder()
+            .method("GET")
+            .uri(path)
+            .body(Body::empty())
+            .unwrap();
+        http_c
+            .request_router(
+                req,
+                Arc::new(HashMap::new()),
+                Arc::new(AtomicUsize::new(0)),
+                Arc::new(IngestCounters::new()),
+            )
+            .wait()
+            .unwrap()
+            .status()
+    }
+
+    #[test]
+    fn webui_disabled() {
+        assert_eq!(run_test_request_router(true, "/ui/"), StatusCode::NOT_FOUND);
+        assert_eq!(
+            run_test_request_router(true, "/ui/assets/app.js"),
+            StatusCode::NOT_FOUND
+        );
+    }
+
+    #[test]
+    fn webui_disabled_keeps_other_routes() {
+        assert_eq!(run_test_request_router(true, "/version"), StatusCode::OK);
+        assert_eq!(run_test_request_router(true, "/"), StatusCode::OK);
+        assert_eq!(run_test_request_router(false, "/version"), StatusCode::OK);
+    }
+
+    // Reads an error response and checks it's a JSON body matching its status
+    fn assert_json_error(resp: Response<Body>, status: StatusCode, message: &str) {
+        assert_eq!(resp.status(), status);
+        assert_eq!(resp.headers().get("Content-Type").unwrap(), APP_JSON);
+        let body = resp.into_body().concat2().wait().unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["error"], message);
+        assert_eq!(payload["code"], status.as_u16());
+    }
+
+    #[test]
+    fn json_error_responses() {
+        assert_json_error(
+            return_400("Invalid token"),
+            StatusCode::BAD_REQUEST,
+            "Bad request: Invalid token",
+        );
+        assert_json_error(return_401(), StatusCode::UNAUTHORIZED, "Unauthorized");
+        assert_json_error(return_404(), StatusCode::NOT_FOUND, "Not Found");
+        assert_json_error(
+            return_500("error saving object"),
+            StatusCode::INTERNAL_SERVER_ERROR,
+            "error saving object",
+        );
+    }
+
+    #[test]
+    fn unknown_route_json_error() {
+        let cfg = get_auth_config_for(VALID_TOKEN.to_string(), "mylog".to_string());
+        let http_c = Http::new(Arc::new(RwLock::new(cfg)));
+        let req = Request::builder()
+            .method("GET")
+            .uri("/unknown/route")
+            .body(Body::empty())
+            .unwrap();
+        let resp = http_c
+            .request_router(
+                req,
+                Arc::new(HashMap::new()),
+                Arc::new(AtomicUsize::new(0)),
+                Arc::new(IngestCounters::new()),
+            )
+            .wait()
+            .unwrap();
+        assert_json_error(resp, StatusCode::NOT_FOUND, "Not Found");
+    }
+
+    // Sends a store of a single line to `mylog`, the body is left open when `pending` so the
+    // ingest stays in flight
+    fn store_request(
+        http_c: &Http,
+        ingests_in_flight: &Arc<AtomicUsize>,
+        pending: bool,
+    ) -> (ResponseFuture, Option<hyper::body::Sender>) {
+        let (sender, body) = if pending {
+            let (sender, body) = Body::channel();
+            (Some(sender), body)
+        } else {
+            (None, Body::from("127.0.0.1 - - GET / 200\n"))
+        };
+        let req = Request::builder()
+            .method("PUT")
+            .uri("/mylog/store")
+            .header("MINSQL-TOKEN", VALID_TOKEN)
+            .body(body)
+            .unwrap();
+        let mut buffers = HashMap::new();
+        buffers.insert("mylog".to_string(), Mutex::new(IngestBuffer::new()));
+        let resp = http_c.request_router(
+            req,
+            Arc::new(buffers),
+            Arc::clone(ingests_in_flight),
+            Arc::new(IngestCounters::new()),
+        );
+        (resp, sender)
+    }
+
+    #[test]
+    fn max_concurrent_ingests_exceeded() {
+        let mut cfg = get_auth_config_for(VALID_TOKEN.to_string(), "mylog".to_string());
+        cfg.server.max_concurrent_ingests = 2;
+        cfg.log.insert(
+            "mylog".to_string(),
+            Log {
+                name: Some("mylog".to_string()),
+                datastores: vec!["ds1".to_string()],
+                commit_window: "5s".to_string(),
+            },
+        );
+        let http_c = Http::new(Arc::new(RwLock::new(cfg)));
+        let ingests_in_flight = Arc::new(AtomicUsize::new(0));
+
+        let first = store_request(&http_c, &ingests_in_flight, true);
+        let _second = store_request(&http_c, &ingests_in_flight, true);
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 2);
+
+        let (third, _) = store_request(&http_c, &ingests_in_flight, false);
+        let resp = third.wait().unwrap();
+        assert_eq!(resp.headers().get(RETRY_AFTER).unwrap(), INGEST_RETRY_AFTER);
+        assert_json_error(
+            resp,
+            StatusCode::SERVICE_UNAVAILABLE,
+            "Too many concurrent log stores",
+        );
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 2);
+
+        // once an ingest is done there's room for another one
+        drop(first);
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 1);
+        let (fourth, _) = store_request(&http_c, &ingests_in_flight, false);
+        assert_eq!(fourth.wait().unwrap().status(), StatusCode::OK);
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 1);
+    }
+
+    #[test]
+    fn log_stats_after_store() {
+        let mut cfg = get_auth_config_for(VALID_TOKEN.to_string(), "mylog".to_string());
+        cfg.log.insert(
+            "mylog".to_string(),
+            Log {
+                name: Some("mylog".to_string()),
+                datastores: vec!["ds1".to_string()],
+                commit_window: "5s".to_string(),
+            },
+        );
+        let http_c = Http::new(Arc::new(RwLock::new(cfg)));
+        let mut buffers = HashMap::new();
+        buffers.insert("mylog".to_string(), Mutex::new(IngestBuffer::new()));
+        let buffers = Arc::new(buffers);
+        let ingest_counters = Arc::new(IngestCounters::new());
+        let route = |method: &str, path: &str, body: &'static str| {
+            let req = Request::builder()
+                .method(method)
+                .uri(path)
+                .header("MINSQL-TOKEN", VALID_TOKEN)
+                .body(Body::from(body))
+                .unwrap();
+            http_c
+                .request_router(
+                    req,
+                    Arc::clone(&buffers),
+                    Arc::new(AtomicUsize::new(0)),
+                    Arc::clone(&ingest_counters),
+                )
+                .wait()
+                .unwrap()
+        };
+
+        let resp = route(
+            "PUT",
+            "/mylog/store",
+            "127.0.0.1 - - GET / 200\n127.0.0.1 - - GET / 404\n",
+        );
+        assert_eq!(resp.status(), StatusCode::OK);
+        let resp = route("GET", "/mylog/stats", "");
+        assert_eq!(resp.status(), StatusCode::OK);
+        let body = resp.into_body().concat2().wait().unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(payload["log"], "mylog");
+        assert_eq!(payload["records"], 2);
+        assert_eq!(payload["bytes"], 48);
+
+        let resp = route("GET", "/otherlog/stats", "");
+        assert_json_error(resp, StatusCode::NOT_FOUND, "Not Found");
+    }
+
+    #[test]
+    fn unlimited_concurrent_ingests() {
+        let ingests_in_flight = Arc::new(AtomicUsize::new(5));
+        let in_flight = InFlightIngest::start(Arc::clone(&ingests_in_flight), 0);
+        assert!(in_flight.is_some());
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 6);
+        drop(in_flight);
+        assert_eq!(ingests_in_flight.load(Ordering::SeqCst), 5);
+    }
 }
@@ -15,10 +15,13 @@
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 use std::collections::HashMap;
+use std::io::Read;
 use std::mem;
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::Mutex;
 use std::sync::{Arc, RwLock};
 
+use flate2::read::GzDecoder;
 use futures::future::Either;
 use futures::{Future, Stream};
 use hyper::header;
@@ -29,7 +32,7 @@ use hyper::StatusCode;
 use log::{error, info};
 
 use crate::config::Config;
-use crate::http::ResponseFuture;
+use crate::http::{return_400, return_error, ResponseFuture};
 use crate::storage::write_to_datastore;
 use std::time::Instant;
 
@@ -48,6 +51,57 @@ impl IngestBuffer {
     }
 }
 
+/// Cumulative counters of the data stored into each log since startup.
+#[derive(Debug, Default)]
+pub struct IngestCounters {
+    logs: RwLock<HashMap<String, LogIngestCounters>>,
+}
+
+#[derive(Debug, Default)]
+struct LogIngestCounters {
+    records: AtomicUsize,
+    bytes: AtomicUsize,
+}
+
+impl LogIngestCounters {
+    fn add(&self, records: usize, bytes: usize) {
+        self.records.fetch_add(records, Ordering::SeqCst);
+        self.bytes.fetch_add(bytes, Ordering::SeqCst);
+    }
+}
+
+impl IngestCounters {
+    pub fn new() -> IngestCounters {
+        IngestCounters::default()
+    }
+
+    /// Counts `records` records and `bytes` bytes as stored into `log_name`.
+    pub fn add(&self, log_name: &str, records: usize, bytes: usize) {
+        if let Some(counters) = self.logs.read().unwrap().get(log_name) {
+            counters.add(records, bytes);
+            return;
+        }
+        // logs can be created while the server runs, their counters start on their first store
+        self.logs
+            .write()
+            .unwrap()
+            .entry(log_name.to_string())
+            .or_insert_with(LogIngestCounters::default)
+            .add(records, bytes);
+    }
+
+    /// Returns the records and bytes stored into `log_name` since startup.
+    pub fn totals(&self, log_name: &str) -> (usize, usize) {
+        match self.logs.read().unwrap().get(log_name) {
+            Some(counters) => (
+                counters.records.load(Ordering::SeqCst),
+                counters.bytes.load(Ordering::SeqCst),
+            ),
+            None => (0, 0),
+        }
+    }
+}
+
 pub struct Ingest {
     config: Arc<RwLock<Config>>,
 }
@@ -62,10 +116,32 @@ impl Ingest {
         &self,
         req: Request<Body>,
         log_ingest_buffers: Arc<HashMap<String, Mutex<IngestBuffer>>>,
+        ingest_counters: Arc<IngestCounters>,
         requested_log: String,
     ) -> ResponseFuture {
         let locked_cfg = Arc::clone(&self.config);
         let flush_cfg = Arc::clone(&self.config);
+        // digest the client computed for the body, if any
+        let content_md5 = req
+            .headers()
+            .get("content-md5")
+            .map(|v| v.to_str().unwrap_or("").to_string());
+        // compression the client applied to the body, if any
+        let content_encoding = req
+            .headers()
+            .get(header::CONTENT_ENCODING)
+            .map(|v| v.to_str().unwrap_or("").trim().to_lowercase());
+        // datastore the data has to be written to, if the client picked one
+        let requested_datastore = req.uri().query().and_then(|uri_query| {
+            url::form_urlencoded::parse(uri_query.as_bytes())
+                .find(|(key, _)| key == "datastore")
+                .map(|(_, value)| value.into_owned())
+        });
+        // key the client uses to recognize retries of the same write
+        let idempotency_key = req
+            .headers()
+            .get("idempotency-key")
+            .map(|v| v.to_str().unwrap_or("").to_string());
 
         // make a clone of the config for the closure
         let cfg = Arc::clone(&self.config);
@@ -75,22 +151,104 @@ impl Ingest {
                 .concat2() // Concatenate all chunks in the body
                 .from_err()
                 .and_then(move |entire_body| {
+                    // Reject bodies that got corrupted on their way here
+                    if let Some(content_md5) = content_md5 {
+                        if let Err(msg) = verify_content_md5(&content_md5, &entire_body) {
+                            return Either::B(futures::future::ok(return_400(msg)));
+                        }
+                    }
+                    // The digest covers the body as sent, so decompress only after checking it
+                    let body = match content_encoding.as_ref().map(String::as_str) {
+                        None | Some("identity") => entire_body.to_vec(),
+                        Some("gzip") => match decode_gzip(&entire_body) {
+                            Ok(body) => body,
+                            Err(_) => {
+                                return Either::B(futures::future::ok(return_400(
+                                    "Body is not valid gzip data",
+                                )));
+                            }
+                        },
+                        Some(_) => {
+                            return Either::B(futures::future::ok(return_error(
+                                StatusCode::UNSUPPORTED_MEDIA_TYPE,
+                                "Content-Encoding must be either `gzip` or `identity`",
+                            )));
+                        }
+                    };
                     // Read the body from the request
-                    let payload: String = match String::from_utf8(entire_body.to_vec()) {
+                    let payload: String = match String::from_utf8(body) {
                         Ok(str) => str,
-                        Err(err) => panic!("Couldn't convert buffer to string: {}", err),
+                        Err(_) => {
+                            return Either::B(futures::future::ok(return_400(
+                                "Log data must be valid UTF-8",
+                            )));
+                        }
                     };
+                    // Nothing to store, avoid writing empty objects
+                    if payload.trim().is_empty() {
+                        let response = Response::builder()
+                            .status(StatusCode::OK)
+                            .header(header::CONTENT_TYPE, "text/plain")
+                            .body(Body::from("ok"))
+                            .unwrap();
+                        return Either::B(futures::future::ok(response));
+                    }
                     let cfg = locked_cfg.read().unwrap();
                     let log = cfg.get_log(&requested_log).unwrap();
+                    // Without datastores there is nowhere to write the data to
+                    if log.datastores.is_empty() {
+                        return Either::B(futures::future::ok(return_400(
+                            "Log has no datastores configured",
+                        )));
+                    }
+                    if let Some(ds_name) = &requested_datastore {
+                        // Buffered data is flushed to any of the datastores of the log
+                        if log.commit_window != "0" {
+                            return Either::B(futures::future::ok(return_400(
+                                "The datastore parameter is only supported by logs with a commit window of 0",
+                            )));
+                        }
+                        if !log.datastores.contains(ds_name) {
+                            return Either::B(futures::future::ok(return_400(&format!(
+                                "Datastore `{}` is not configured for log `{}`",
+                                ds_name, requested_log
+                            ))));
+                        }
+                    }
+                    if let Some(key) = &idempotency_key {
+                        // Buffered data from several requests ends up in the same object
+                        if log.commit_window != "0" {
+                            return Either::B(futures::future::ok(return_400(
+                                "The Idempotency-Key header is only supported by logs with a commit window of 0",
+                            )));
+                        }
+                        if key.is_empty() {
+                            return Either::B(futures::future::ok(return_400(
+                                "Idempotency-Key cannot be empty",
+                            )));
+                        }
+                    }
+                    let records = payload.lines().filter(|l| !l.trim().is_empty()).count();
+                    let bytes = payload.len();
                     // if the commit window is 0s, commit immediately
                     if log.commit_window == "0" {
                         let cfg = Arc::clone(&ingest_c.config);
                         let plen = payload.len() as i64;
+                        let log_name = requested_log.clone();
                         let response_body =
-                            write_to_datastore(cfg, &requested_log, vec![payload], plen).then(
-                                |res| -> Result<Response<Body>, _> {
+                            write_to_datastore(
+                                cfg,
+                                &requested_log,
+                                requested_datastore.as_ref().map(|ds_name| &ds_name[..]),
+                                idempotency_key.as_ref().map(|key| &key[..]),
+                                vec![payload],
+                                plen,
+                            )
+                            .then(
+                                move |res| -> Result<Response<Body>, _> {
                                     match res {
                                         Ok(_) => {
+                                            ingest_counters.add(&log_name, records, bytes);
                                             // Send response that the request has been received successfully
                                             let response = Response::builder()
                                                 .status(StatusCode::OK)
@@ -101,12 +259,10 @@ impl Ingest {
                                         }
                                         Err(e) => {
                                             error!("{:?}", e);
-                                            let response = Response::builder()
-                                                .status(StatusCode::INSUFFICIENT_STORAGE)
-                                                .header(header::CONTENT_TYPE, "text/plain")
-                                                .body(Body::from("fail"))
-                                                .unwrap();
-                                            Ok(response)
+                                            Ok(return_error(
+                                                StatusCode::INSUFFICIENT_STORAGE,
+                                                "Could not store log data",
+                                            ))
                                         }
                                     }
                                 },
@@ -124,6 +280,7 @@ impl Ingest {
                         total_bytes = protected_data.total_bytes.clone();
 
                         drop(protected_data);
+                        ingest_counters.add(&requested_log, records, bytes);
                         // if we are above storage threshold, we will flush the data
                         if total_bytes > 5 * 1024 * 1024 {
                             info!("Buffer above 5MB, flushing.");
@@ -170,15 +327,16 @@ impl Ingest {
         if data_len > 0 {
             // Write the data to object storage
             let cfg = Arc::clone(&self.config);
-            let res = write_to_datastore(cfg, &log_name, flushed_data, total_bytes as i64)
-                .then(|we| {
-                    if let Err(e) = &we {
-                        error!("Problem flushing data out!! {:?}", e);
-                    };
-                    we
-                })
-                .map(|_| ())
-                .map_err(|_| ());
+            let res =
+                write_to_datastore(cfg, &log_name, None, None, flushed_data, total_bytes as i64)
+                    .then(|we| {
+                        if let Err(e) = &we {
+                            error!("Problem flushing data out!! {:?}", e);
+                        };
+                        we
+                    })
+                    .map(|_| ())
+                    .map_err(|_| ());
             //TODO: Remove this line later on
             let duration = start.elapsed();
             info!(
@@ -191,3 +349,339 @@ impl Ingest {
         }
     }
 }
+
+/// Checks the base64 encoded MD5 digest of a `Content-MD5` header against the body it came with.
+fn verify_content_md5(content_md5: &str, body: &[u8]) -> Result<(), &'static str> {
+    match base64::decode(content_md5) {
+        Ok(ref digest) if digest.len() == 16 => {
+            if &digest[..] == &md5::compute(body)[..] {
+                Ok(())
+            } else {
+                Err("Content-MD5 does not match the body")
+            }
+        }
+        _ => Err("Content-MD5 must be a base64 encoded MD5 digest"),
+    }
+}
+
+/// Decompresses a gzip encoded request body.
+fn decode_gzip(body: &[u8]) -> std::io::Result<Vec<u8>> {
+    let mut decoded = Vec::new();
+    GzDecoder::new(body).read_to_end(&mut decoded)?;
+    Ok(decoded)
+}
+
+#[cfg(test)]
+mod ingest_tests {
+    use crate::config::{Log, Server};
+
+    use super::*;
+
+    // Generates a Config object with a single log using the given commit window
+    fn get_log_config_for(log_name: &str, commit_window: &str) -> Config {
+        let mut cfg = Config::new(Server {
+            address: "".to_string(),
+            metadata_endpoint: "".to_string(),
+            metadata_bucket: "".to_string(),
+            access_key: "".to_string(),
+            secret_key: "".to_string(),
+            pkcs12_cert: None,
+            pkcs12_password: None,
+            max_query_bytes: 10485760,
+            disable_webui: false,
+            max_concurrent_ingests: 0,
+        });
+        cfg.log.insert(
+            log_name.to_string(),
+            Log {
+                name: Some(log_name.to_string()),
+                datastores: vec!["ds1".to_string()],
+                commit_window: commit_window.to_string(),
+            },
+        );
+        cfg
+    }
+
+    // Stores `body` into `mylog` and returns the status of the response along with the buffer
+    fn run_test_store(
+        commit_window: &str,
+        body: &'static str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        run_test_store_with_config(get_log_config_for("mylog", commit_window), body)
+    }
+
+    fn run_test_store_with_config(
+        cfg: Config,
+        body: &'static str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let req = Request::builder()
+            .method("PUT")
+            .uri("/mylog/store")
+            .body(Body::from(body))
+            .unwrap();
+        run_test_store_request(cfg, req)
+    }
+
+    fn run_test_store_request(
+        cfg: Config,
+        req: Request<Body>,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        run_test_store_counted(cfg, req, Arc::new(IngestCounters::new()))
+    }
+
+    fn run_test_store_counted(
+        cfg: Config,
+        req: Request<Body>,
+        ingest_counters: Arc<IngestCounters>,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let cfg = Arc::new(RwLock::new(cfg));
+        let mut buffers = HashMap::new();
+        buffers.insert("mylog".to_string(), Mutex::new(IngestBuffer::new()));
+        let buffers = Arc::new(buffers);
+
+        let ingest_c = Ingest::new(cfg);
+        let resp = ingest_c
+            .api_log_store(
+                req,
+                Arc::clone(&buffers),
+                ingest_counters,
+                "mylog".to_string(),
+            )
+            .wait()
+            .unwrap();
+        (resp.status(), buffers)
+    }
+
+    fn buffered_lines(buffers: &Arc<HashMap<String, Mutex<IngestBuffer>>>) -> usize {
+        buffers.get("mylog").unwrap().lock().unwrap().data.len()
+    }
+
+    #[test]
+    fn store_empty_body() {
+        // an immediate commit would reach the datastore if anything was written
+        let (status, _) = run_test_store("0", "");
+        assert_eq!(status, StatusCode::OK);
+        let (status, buffers) = run_test_store("5s", "");
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    #[test]
+    fn store_whitespace_body() {
+        let (status, _) = run_test_store("0", " \n\t\n");
+        assert_eq!(status, StatusCode::OK);
+        let (status, buffers) = run_test_store("5s", " \n\t\n");
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    #[test]
+    fn store_single_record() {
+        let (status, buffers) = run_test_store("5s", "127.0.0.1 - - GET /index.html 200\n");
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(buffered_lines(&buffers), 1);
+    }
+
+    #[test]
+    fn store_log_without_datastores() {
+        let mut cfg = get_log_config_for("mylog", "0");
+        cfg.log.get_mut("mylog").unwrap().datastores = Vec::new();
+        let (status, buffers) = run_test_store_with_config(cfg, "127.0.0.1 - - GET / 200\n");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    #[test]
+    fn store_counts_records_and_bytes() {
+        let ingest_counters = Arc::new(IngestCounters::new());
+        let bodies = vec![
+            "127.0.0.1 - - GET / 200\n127.0.0.1 - - GET / 404\n",
+            "127.0.0.1 - - GET / 500\n\n",
+            // nothing is stored for blank bodies
+            " \n",
+        ];
+        for body in bodies {
+            let req = Request::builder()
+                .method("PUT")
+                .uri("/mylog/store")
+                .body(Body::from(body))
+                .unwrap();
+            run_test_store_counted(
+                get_log_config_for("mylog", "5s"),
+                req,
+                Arc::clone(&ingest_counters),
+            );
+        }
+        assert_eq!(ingest_counters.totals("mylog"), (3, 73));
+        assert_eq!(ingest_counters.totals("otherlog"), (0, 0));
+    }
+
+    #[test]
+    fn concurrent_ingest_counters() {
+        let ingest_counters = Arc::new(IngestCounters::new());
+        let threads: Vec<_> = (0..8)
+            .map(|_| {
+                let ingest_counters = Arc::clone(&ingest_counters);
+                std::thread::spawn(move || {
+                    for _ in 0..100 {
+                        ingest_counters.add("mylog", 2, 10);
+                    }
+                })
+            })
+            .collect();
+        for thread in threads {
+            thread.join().unwrap();
+        }
+        assert_eq!(ingest_counters.totals("mylog"), (1600, 8000));
+    }
+
+    fn run_test_store_with_md5(
+        body: &'static str,
+        content_md5: &str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let req = Request::builder()
+            .method("PUT")
+            .uri("/mylog/store")
+            .header("Content-MD5", content_md5)
+            .body(Body::from(body))
+            .unwrap();
+        run_test_store_request(get_log_config_for("mylog", "5s"), req)
+    }
+
+    #[test]
+    fn store_with_matching_content_md5() {
+        let body = "127.0.0.1 - - GET / 200\n";
+        let content_md5 = base64::encode(&md5::compute(body)[..]);
+        let (status, buffers) = run_test_store_with_md5(body, &content_md5);
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(buffered_lines(&buffers), 1);
+    }
+
+    #[test]
+    fn store_with_mismatched_content_md5() {
+        let content_md5 = base64::encode(&md5::compute("127.0.0.1 - - GET / 404\n")[..]);
+        let (status, buffers) = run_test_store_with_md5("127.0.0.1 - - GET / 200\n", &content_md5);
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    #[test]
+    fn store_with_invalid_content_md5() {
+        let (status, buffers) =
+            run_test_store_with_md5("127.0.0.1 - - GET / 200\n", "not-a-digest");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    fn run_test_store_with_encoding(
+        body: Vec<u8>,
+        content_encoding: &str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let req = Request::builder()
+            .method("PUT")
+            .uri("/mylog/store")
+            .header("Content-Encoding", content_encoding)
+            .body(Body::from(body))
+            .unwrap();
+        run_test_store_request(get_log_config_for("mylog", "5s"), req)
+    }
+
+    #[test]
+    fn store_gzip_body() {
+        use std::io::Write;
+
+        let mut encoder = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+        encoder
+            .write_all(b"127.0.0.1 - - GET / 200\n127.0.0.1 - - GET / 404\n")
+            .unwrap();
+        let (status, buffers) = run_test_store_with_encoding(encoder.finish().unwrap(), "gzip");
+        assert_eq!(status, StatusCode::OK);
+        let buffer = buffers.get("mylog").unwrap().lock().unwrap();
+        assert_eq!(
+            buffer.data,
+            vec!["127.0.0.1 - - GET / 200\n127.0.0.1 - - GET / 404\n".to_string()]
+        );
+    }
+
+    #[test]
+    fn store_invalid_gzip_body() {
+        let (status, buffers) =
+            run_test_store_with_encoding(b"127.0.0.1 - - GET / 200\n".to_vec(), "gzip");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    #[test]
+    fn store_unsupported_encoding() {
+        let (status, buffers) =
+            run_test_store_with_encoding(b"127.0.0.1 - - GET / 200\n".to_vec(), "br");
+        assert_eq!(status, StatusCode::UNSUPPORTED_MEDIA_TYPE);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    fn run_test_store_to_datastore(
+        commit_window: &str,
+        datastore: &str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let uri = format!("/mylog/store?datastore={}", datastore);
+        let req = Request::builder()
+            .method("PUT")
+            .uri(&uri[..])
+            .body(Body::from("127.0.0.1 - - GET / 200\n"))
+            .unwrap();
+        run_test_store_request(get_log_config_for("mylog", commit_window), req)
+    }
+
+    #[test]
+    fn store_to_requested_datastore() {
+        // `ds1` is accepted, writing fails since the datastore itself isn't configured
+        let (status, _) = run_test_store_to_datastore("0", "ds1");
+        assert_eq!(status, StatusCode::INSUFFICIENT_STORAGE);
+    }
+
+    #[test]
+    fn store_to_datastore_not_in_log() {
+        let (status, _) = run_test_store_to_datastore("0", "ds2");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+    }
+
+    #[test]
+    fn store_to_datastore_of_buffered_log() {
+        let (status, buffers) = run_test_store_to_datastore("5s", "ds1");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+
+    fn run_test_store_with_idempotency_key(
+        commit_window: &str,
+        key: &str,
+    ) -> (StatusCode, Arc<HashMap<String, Mutex<IngestBuffer>>>) {
+        let req = Request::builder()
+            .method("PUT")
+            .uri("/mylog/store")
+            .header("Idempotency-Key", key)
+            .body(Body::from("127.0.0.1 - - GET / 200\n"))
+            .unwrap();
+        run_test_store_request(get_log_config_for("mylog", commit_window), req)
+    }
+
+    #[test]
+    fn store_with_idempotency_key() {
+        // the key is accepted, writing fails since `ds1` itself isn't configured
+        let (status, _) = run_test_store_with_idempotency_key("0", "batch-42");
+        assert_eq!(status, StatusCode::INSUFFICIENT_STORAGE);
+    }
+
+    #[test]
+    fn store_with_empty_idempotency_key() {
+        let (status, _) = run_test_store_with_idempotency_key("0", "");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+    }
+
+    #[test]
+    fn store_with_idempotency_key_to_buffered_log() {
+        let (status, buffers) = run_test_store_with_idempotency_key("5s", "batch-42");
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        assert_eq!(buffered_lines(&buffers), 0);
+    }
+}
@@ -21,13 +21,14 @@ use std::collections::HashMap;
 use std::fs::File;
 use std::io::{self, Read};
 use std::process;
+use std::sync::atomic::AtomicUsize;
 use std::sync::Mutex;
 use std::sync::{Arc, RwLock};
 use std::time::Duration;
 use std::time::Instant;
 
 use crate::config::Config;
-use crate::ingest::{Ingest, IngestBuffer};
+use crate::ingest::{Ingest, IngestBuffer, IngestCounters};
 use crate::meta::Meta;
 use futures::{future, Future, Stream};
 use hyper::server::conn::Http;
@@ -114,6 +115,10 @@ impl MinSQL {
             Arc::new(log_ingest_buffers_map);
         // create a referece to the hashmap that we will share across intervals below
         let ingest_buffer_interval = Arc::clone(&log_ingest_buffers);
+        // log stores being processed across all connections
+        let ingests_in_flight = Arc::new(AtomicUsize::new(0));
+        // data stored into each log since startup
+        let ingest_counters = Arc::new(IngestCounters::new());
 
         let addr = self.config.read().unwrap().server.address.parse().unwrap();
 
@@ -121,13 +126,17 @@ impl MinSQL {
         // Hyper Service Function that will serve each request as a new task
         let new_service = move || {
             let log_ingest_buffers = Arc::clone(&log_ingest_buffers);
+            let ingests_in_flight = Arc::clone(&ingests_in_flight);
+            let ingest_counters = Arc::clone(&ingest_counters);
             let inner_service_cfg = Arc::clone(&service_cfg);
 
             let http_c = http::Http::new(inner_service_cfg);
             // Move a clone of `configuration` into the `service_fn`.
             service_fn(move |req| {
                 let log_ingest_buffers = Arc::clone(&log_ingest_buffers);
-                http_c.request_router(req, log_ingest_buffers)
+                let ingests_in_flight = Arc::clone(&ingests_in_flight);
+                let ingest_counters = Arc::clone(&ingest_counters);
+                http_c.request_router(req, log_ingest_buffers, ingests_in_flight, ingest_counters)
             })
         };
 
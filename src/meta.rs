@@ -141,14 +141,31 @@ impl Meta {
                                 .split("/")
                                 .collect();
                             let meta_obj = match (parts.len(), parts[0]) {
-                                (2, "logs") => match serde_json::from_str(&result) {
-                                    Ok(t) => MetaConfigObject::Log(t),
-                                    Err(_) => MetaConfigObject::Unknown,
-                                },
-                                (2, "datastores") => match serde_json::from_str(&result) {
-                                    Ok(t) => MetaConfigObject::DataStore(t),
+                                (2, "logs") => match serde_json::from_str::<Log>(&result) {
+                                    Ok(t) => match t.validate() {
+                                        Ok(_) => MetaConfigObject::Log(t),
+                                        Err(e) => {
+                                            error!("error loading log configuration {}", e);
+                                            MetaConfigObject::Unknown
+                                        }
+                                    },
                                     Err(_) => MetaConfigObject::Unknown,
                                 },
+                                (2, "datastores") => {
+                                    match serde_json::from_str::<DataStore>(&result) {
+                                        Ok(mut t) => match t.resolve_env_references() {
+                                            Ok(_) => MetaConfigObject::DataStore(t),
+                                            Err(e) => {
+                                                error!(
+                                                    "error loading datastore configuration {}",
+                                                    e
+                                                );
+                                                MetaConfigObject::Unknown
+                                            }
+                                        },
+                                        Err(_) => MetaConfigObject::Unknown,
+                                    }
+                                }
                                 (2, "tokens") => match serde_json::from_str(&result) {
                                     Ok(t) => MetaConfigObject::Token(t),
                                     Err(_) => MetaConfigObject::Unknown,
@@ -281,24 +298,34 @@ fn load_config_for_key(cfg: Arc<RwLock<Config>>, object_key: String) {
                         .split("/")
                         .collect();
                     match (parts.len(), parts[0]) {
-                        (2, "logs") => match serde_json::from_str(&result) {
-                            Ok(log) => {
-                                let mut cfg_write = cfg2.write().unwrap();
-                                info!("Loading log: {}", &parts[1]);
-                                cfg_write.log.insert(parts[1].to_string(), log);
-                                drop(cfg_write);
-                            }
+                        (2, "logs") => match serde_json::from_str::<Log>(&result) {
+                            Ok(log) => match log.validate() {
+                                Ok(_) => {
+                                    let mut cfg_write = cfg2.write().unwrap();
+                                    info!("Loading log: {}", &parts[1]);
+                                    cfg_write.log.insert(parts[1].to_string(), log);
+                                    drop(cfg_write);
+                                }
+                                Err(e) => {
+                                    error!("error loading log configuration {}", e);
+                                }
+                            },
                             Err(e) => {
                                 error!("error loading log configuration {}", e);
                             }
                         },
-                        (2, "datastores") => match serde_json::from_str(&result) {
-                            Ok(datastore) => {
-                                let mut cfg_write = cfg2.write().unwrap();
-                                info!("Loading datastore: {}", &parts[1]);
-                                cfg_write.datastore.insert(parts[1].to_string(), datastore);
-                                drop(cfg_write);
-                            }
+                        (2, "datastores") => match serde_json::from_str::<DataStore>(&result) {
+                            Ok(mut datastore) => match datastore.resolve_env_references() {
+                                Ok(_) => {
+                                    let mut cfg_write = cfg2.write().unwrap();
+                                    info!("Loading datastore: {}", &parts[1]);
+                                    cfg_write.datastore.insert(parts[1].to_string(), datastore);
+                                    drop(cfg_write);
+                                }
+                                Err(e) => {
+                                    error!("error loading datastore configuration {}", e);
+                                }
+                            },
                             Err(e) => {
                                 error!("error loading datastore configuration {}", e);
                             }
@@ -381,6 +408,11 @@ pub fn ds_for_metabucket(cfg: Arc<RwLock<Config>>) -> DataStore {
         bucket: read_cfg.server.metadata_bucket.clone(),
         prefix: "".to_owned(),
         name: Some("metabucket".to_owned()),
+        region: None,
+        sse: None,
+        sse_kms_key_id: None,
+        auto_create_bucket: false,
+        stored: None,
     }
 }
 
@@ -19,16 +19,23 @@ use std::collections::HashSet;
 use std::error;
 use std::error::Error;
 use std::fmt;
+use std::io::Write;
+use std::mem;
 use std::sync::{Arc, RwLock};
 
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use futures::future::Either;
 use futures::sink::Sink;
-use futures::{stream, Future, Stream};
-use hyper::{Body, Chunk, Request, Response};
+use futures::{future, stream, Future, Stream};
+use hyper::{header, Body, Chunk, Method, Request, Response};
 use log::{error, info};
 use regex::Regex;
 use serde_derive::{Deserialize, Serialize};
 use serde_json::json;
-use sqlparser::ast::{BinaryOperator, Expr, SelectItem, SetExpr, Statement, Value};
+use sqlparser::ast::{
+    BinaryOperator, Expr, Select, SelectItem, SetExpr, Statement, TableFactor, Value,
+};
 use sqlparser::parser::Parser;
 use sqlparser::parser::ParserError;
 use tokio::sync::mpsc;
@@ -37,14 +44,14 @@ use lazy_static::lazy_static;
 
 use crate::auth::Auth;
 use crate::combinators::take_from_iterable::TakeFromIterable;
-use crate::config::Config;
+use crate::config::{Config, DataStore, Log};
 use crate::constants;
 use crate::constants::{SF_USER_AGENT, SMART_FIELDS_RAW_RE};
 use crate::dialect::MinSQLDialect;
 use crate::filter::line_fails_query_conditions;
 use crate::http::GenericError;
 use crate::http::ResponseFuture;
-use crate::http::{return_400, return_401};
+use crate::http::{return_400, return_401, return_413, return_500};
 use crate::hyperscan::{
     build_hs_db, found_patterns_in_line, HSLineScanner, HSPatternMatch, HSPatternMatchResults,
 };
@@ -100,7 +107,9 @@ pub enum QueryError {
 
 impl fmt::Display for QueryError {
     fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
-        write!(f, "{:?}", self)
+        match self {
+            QueryError::Underlying(s) => write!(f, "{}", s),
+        }
     }
 }
 
@@ -141,37 +150,39 @@ impl Query {
         }
     }
 
-    pub fn validate_logs(&self, ast: &Vec<Statement>) -> Option<GenericError> {
+    /// Validates the logs referenced by the queries exist, returns an `UnsupportedQuery` error if
+    /// a query references more than one log.
+    pub fn validate_logs(&self, ast: &Vec<Statement>) -> Option<ProcessingQueryError> {
         let cfg = self.config.read().unwrap();
         // Validate all the tables for all the  queries, we don't want to start serving content
         // for the first query and then discover subsequent queries are invalid
         for query in ast {
-            // find the table they want to query
-            let some_table = match query {
+            // find the tables they want to query
+            let tables = match query {
                 Statement::Query(q) => match q.body {
-                    // TODO: Validate a single table
-                    SetExpr::Select(ref bodyselect) => {
-                        if bodyselect.from.len() == 0 {
-                            None
-                        } else {
-                            Some(bodyselect.from[0].relation.clone())
-                        }
-                    }
-                    _ => None,
+                    SetExpr::Select(ref bodyselect) => tables_in_select(bodyselect),
+                    _ => Vec::new(),
                 },
                 _ => {
                     error!("Not the type of query we support");
-                    None
+                    Vec::new()
                 }
             };
-            if some_table == None {
+            if tables.len() == 0 {
                 error!("No table found");
-                return Some(ParseSqlError.into());
+                return Some(ProcessingQueryError::NoTableFound(
+                    "No table was found in the query statement".to_string(),
+                ));
             }
-            let table = some_table.unwrap().to_string();
-            let loggy = cfg.get_log(&table);
-            if loggy.is_none() {
-                return Some(ParseSqlError.into());
+            // Report multiple logs before missing ones, the query can't run either way
+            if tables.len() > 1 {
+                return Some(multiple_logs_error(&tables));
+            }
+            for table in &tables {
+                let loggy = cfg.get_log(table);
+                if loggy.is_none() {
+                    return Some(ProcessingQueryError::Fail("invalid log name".to_string()));
+                }
             }
         }
         None
@@ -219,183 +230,208 @@ impl Query {
             None => false,
         };
 
+        // Figure out where the query text is coming from
+        let query_source = if req.method() == &Method::GET {
+            QuerySource::Parameter(req.uri().query().unwrap_or("").to_string())
+        } else {
+            match req.headers().get(header::CONTENT_TYPE) {
+                Some(val) if val.to_str().unwrap_or("").starts_with(constants::APP_JSON) => {
+                    QuerySource::Json
+                }
+                _ => QuerySource::Raw,
+            }
+        };
+
+        // Check for the `shape` of the output, either JSON lines or a JSON array
+        let output_shape = match OutputShape::from_uri_query(req.uri().query().unwrap_or("")) {
+            Some(shape) => shape,
+            None => {
+                return Box::new(future::ok(return_400(
+                    "Output shape must be either `lines` or `array`",
+                )));
+            }
+        };
+
+        // Compress the output if the client can take it
+        let gzip_output = accepts_gzip(&req);
+
+        let max_query_bytes = query_c.config.read().unwrap().server.max_query_bytes;
+
         let query_state_holder = Arc::new(RwLock::new(StateHolder::new()));
         let query_state_holder = Arc::clone(&query_state_holder);
         // A web api to run against
-        Box::new(
-            req.into_body()
-                .concat2() // Concatenate all chunks in the body
-                .from_err()
-                .and_then(move |entire_body| {
-                    let payload: String = match String::from_utf8(entire_body.to_vec()) {
-                        Ok(str) => str,
-                        Err(_) => {
-                            return Ok(return_400("Could not understand request"));
-                        }
-                    };
-                    let ast = match query_c.parse_query(payload) {
-                        Ok(v) => v,
-                        Err(e) => {
-                            return Ok(return_400(format!("{:?}", e).as_str()));
-                        }
-                    };
-                    if let Some(_) = query_c.validate_logs(&ast) {
-                        return Ok(return_400("invalid log name"));
-                    };
-
-                    // Translate the SQL AST into a `QueryParsing`
-                    // that has all the elements needed to continue
-                    let parsed_queries = match query_c.process_sql(&access_token, ast, explore_query) {
-                        Ok(v) => v,
-                        Err(e) => {
-                            return match e {
-                                ProcessingQueryError::Fail(s) => Ok(return_400(s.clone().as_str())),
-                                ProcessingQueryError::UnsupportedQuery(s) => {
-                                    Ok(return_400(s.clone().as_str()))
-                                }
-                                ProcessingQueryError::NoTableFound(s) => {
-                                    Ok(return_400(s.clone().as_str()))
-                                }
-                                ProcessingQueryError::Unauthorized(_s) => Ok(return_401()),
-                            };
-                        }
+        Box::new(read_query_body(req.into_body(), max_query_bytes).and_then(
+            move |entire_body| -> ResponseFuture {
+                let entire_body = match entire_body {
+                    Some(body) => body,
+                    None => {
+                        return Box::new(future::ok(return_413(&format!(
+                            "Query exceeds the maximum size of {} bytes",
+                            max_query_bytes
+                        ))));
+                    }
+                };
+                let payload: String = match String::from_utf8(entire_body) {
+                    Ok(str) => str,
+                    Err(_) => {
+                        return Box::new(future::ok(return_400("Could not understand request")));
+                    }
+                };
+                let payload = match extract_query_text(query_source, payload) {
+                    Some(q) => q,
+                    None => {
+                        return Box::new(future::ok(return_400("No query found in request")));
+                    }
+                };
+                let ast = match query_c.parse_query(payload) {
+                    Ok(v) => v,
+                    Err(e) => {
+                        return Box::new(future::ok(return_400(format!("{:?}", e).as_str())));
+                    }
+                };
+                if let Some(e) = query_c.validate_logs(&ast) {
+                    let response = match e {
+                        ProcessingQueryError::UnsupportedQuery(s) => return_400(&s),
+                        _ => return_400("invalid log name"),
                     };
-                    let total_querys = parsed_queries.len();
-                    let mut writable_state = query_state_holder.write().unwrap();
-                    writable_state.query_parsing = parsed_queries;
-                    //release lock
-                    drop(writable_state);
-
-                    // prepare copies to go into the next future
-
-                    let cfg = Arc::clone(&query_c.config);
-
-                    let query_state_holder = Arc::clone(&query_state_holder);
-
-                    let body_str = stream::iter_ok::<_, QueryError>(0..total_querys)
-                        .map(move |query_index| {
-                            // for each query parse, read from all datasources for the log
-                            let read_state_holder = query_state_holder.read().unwrap();
-                            let q_parse = &read_state_holder.query_parsing[query_index].1;
-                            let cfg_read = cfg.read().unwrap();
-                            let log = cfg_read.get_log(&q_parse.log_name).unwrap();
-                            let log_datastores = &log.datastores;
-
-                            let mut limit = q_parse.limit.unwrap_or(std::u64::MAX);
-                            if preview_query {
-                                limit = 20 as u64;
+                    return Box::new(future::ok(response));
+                };
+
+                // Translate the SQL AST into a `QueryParsing`
+                // that has all the elements needed to continue
+                let parsed_queries = match query_c.process_sql(&access_token, ast, explore_query) {
+                    Ok(v) => v,
+                    Err(e) => {
+                        let response = match e {
+                            ProcessingQueryError::Fail(s) => return_400(s.clone().as_str()),
+                            ProcessingQueryError::UnsupportedQuery(s) => {
+                                return_400(s.clone().as_str())
                             }
-                            //drop the read lock
-                            drop(read_state_holder);
-
-                            let logs_ds_len = log_datastores.len();
-
-                            // prepare copies to go into the next future
-                            let cfg = Arc::clone(&cfg);
-                            let query_state_holder = Arc::clone(&query_state_holder);
-                            let query_state_holder3 = Arc::clone(&query_state_holder);
-
-                            let (tx, rx) = mpsc::unbounded_channel::<Vec<String>>();
-                            // For each datastore in the log we are going to spawn a task to read the
-                            // logs stored in given datastore.
-                            for i in 0..logs_ds_len {
-                                let ds_name = &log_datastores[i];
-                                if cfg_read.datastore.contains_key(ds_name) {
-                                    let cfg2 = Arc::clone(&cfg);
-                                    let query_state_holder2 = Arc::clone(&query_state_holder);
-                                    let tx = tx.clone();
-                                    // Task that will read all the logs for a given datastore
-                                    let task = stream::iter_ok(i..i + 1)
-                                        .map(move |log_ds_index| {
-                                            let cfg2 = Arc::clone(&cfg2);
-                                            let query_state_holder2 =
-                                                Arc::clone(&query_state_holder2);
-                                            // let log_ds_index = log_ds_index.clone();
-                                            Query::read_logs_from_datastore(
-                                                cfg2,
-                                                query_state_holder2,
-                                                query_index,
-                                                log_ds_index,
-                                            )
-                                        })
-                                        .flatten()
-                                        .fold(tx, |tx, lines| {
-                                            tx.send(lines).map_err(|e| {
-                                                QueryError::Underlying(format!("{:?}", e))
-                                            })
-                                        })
-                                        .map_err(|_| ())
-                                        .map(|_| ());
-                                    tokio::spawn(task);
-                                } else {
-                                    error!("Log `{:?}` references datastore `{}` which is not present in the configuration.", &log.name, &ds_name);
-                                }
+                            ProcessingQueryError::NoTableFound(s) => return_400(s.clone().as_str()),
+                            ProcessingQueryError::Unauthorized(_s) => return_401(),
+                        };
+                        return Box::new(future::ok(response));
+                    }
+                };
+                let total_querys = parsed_queries.len();
+                let mut writable_state = query_state_holder.write().unwrap();
+                writable_state.query_parsing = parsed_queries;
+                //release lock
+                drop(writable_state);
+
+                // prepare copies to go into the next future
+
+                let cfg = Arc::clone(&query_c.config);
+
+                let query_state_holder = Arc::clone(&query_state_holder);
+
+                let body_str = stream::iter_ok::<_, QueryError>(0..total_querys)
+                    .map(move |query_index| {
+                        // for each query parse, read from all datasources for the log
+                        let read_state_holder = query_state_holder.read().unwrap();
+                        let q_parse = &read_state_holder.query_parsing[query_index].1;
+                        let q_log_name = q_parse.log_name.clone();
+                        let mut limit = q_parse.limit.unwrap_or(std::u64::MAX);
+                        if preview_query {
+                            limit = 20 as u64;
+                        }
+                        //drop the read lock
+                        drop(read_state_holder);
+
+                        // the log may have been removed since the query was validated
+                        let cfg_read = cfg.read().unwrap();
+                        let to_read = log_datastores_to_read(&cfg_read, &q_log_name);
+                        drop(cfg_read);
+                        let to_read = match to_read {
+                            Some(v) => v,
+                            None => {
+                                return Either::B(stream::once(Err(QueryError::Underlying(
+                                    format!("Log `{}` is no longer configured", q_log_name),
+                                ))));
                             }
+                        };
+
+                        // prepare copies to go into the next future
+                        let query_state_holder3 = Arc::clone(&query_state_holder);
+
+                        let (tx, rx) = mpsc::unbounded_channel::<Result<Vec<String>, QueryError>>();
+                        // For each datastore in the log we are going to spawn a task to read the
+                        // logs stored in given datastore.
+                        for (ds_name, ds) in to_read {
+                            let tx = tx.clone();
+                            // Task that will read all the logs for a given datastore
+                            let lines = Query::read_logs_from_datastore(q_log_name.clone(), ds);
+                            let task =
+                                forward_datastore_lines(lines, tx, q_log_name.clone(), ds_name);
+                            tokio::spawn(task);
+                        }
 
-                            rx.map_err(|e| QueryError::Underlying(format!("{:?}", e))) //temporarely remove error, we need to adress this
-                                .map(move |lines| {
-                                    // Perform scan via Hyperscan
-                                    // TODO: Remove the lock around the DB as this is definetively a problem
-                                    let query_state_holder4 = Arc::clone(&query_state_holder3);
-                                    let mut write_state_holder =
-                                        query_state_holder4.write().unwrap();
-
-                                    let (ref mut _q, ref mut q_parse) = *write_state_holder
-                                        .query_parsing
-                                        .get_mut(query_index)
-                                        .unwrap();
-
-                                    let pattern_match_results: HSPatternMatchResults =
-                                        match q_parse.hs_db.take() {
-                                            Some(mut db) => {
-                                                //                                            let bdb = q_parse.hs_db.take();
-                                                //                                            let mut db = bdb.unwrap();
-
-                                                let mut ls = HSLineScanner::new(&lines);
-                                                let pattern_match_results = ls.scan(&mut db);
-                                                // drop ls so the borrow on lines is returned
-                                                drop(ls);
-
-                                                q_parse.hs_db = Some(db);
-                                                pattern_match_results
-                                            }
-                                            None => Arc::new(RwLock::new(HashMap::new())),
-                                        };
-                                    // Drop the write lock
-                                    drop(write_state_holder);
-
-                                    // lets process the results
-
-                                    let read_state_holder = query_state_holder3.read().unwrap();
-                                    let (ref query, ref query_data) =
-                                        *(&read_state_holder.query_parsing[query_index]);
-
-                                    let res = lines
-                                        .into_iter()
-                                        .enumerate()
-                                        .filter_map(|(line_index, line)| {
-                                            let pattern_match_results2 =
-                                                Arc::clone(&pattern_match_results);
-                                            evaluate_query_on_line(
-                                                query,
-                                                query_data,
-                                                line_index,
-                                                line,
-                                                pattern_match_results2,
-                                            )
-                                        })
-                                        .collect::<Vec<String>>();
-                                    drop(read_state_holder);
-
-                                    res
-                                })
-                                .take_from_iterable(limit)
-                        })
-                        .flatten()
-                        .map(|s: Vec<String>| Chunk::from(s.join("\n") + &"\n"));
-                    Ok(Response::new(Body::wrap_stream(body_str)))
-                }),
-        )
+                        let results = rx
+                            .map_err(|e| QueryError::Underlying(format!("{:?}", e)))
+                            // a failed datastore turns into an error of the results
+                            .and_then(|lines| lines)
+                            .map(move |lines| {
+                                // Perform scan via Hyperscan
+                                // TODO: Remove the lock around the DB as this is definetively a problem
+                                let query_state_holder4 = Arc::clone(&query_state_holder3);
+                                let mut write_state_holder = query_state_holder4.write().unwrap();
+
+                                let (ref mut _q, ref mut q_parse) = *write_state_holder
+                                    .query_parsing
+                                    .get_mut(query_index)
+                                    .unwrap();
+
+                                let pattern_match_results: HSPatternMatchResults =
+                                    match q_parse.hs_db.take() {
+                                        Some(mut db) => {
+                                            //                                            let bdb = q_parse.hs_db.take();
+                                            //                                            let mut db = bdb.unwrap();
+
+                                            let mut ls = HSLineScanner::new(&lines);
+                                            let pattern_match_results = ls.scan(&mut db);
+                                            // drop ls so the borrow on lines is returned
+                                            drop(ls);
+
+                                            q_parse.hs_db = Some(db);
+                                            pattern_match_results
+                                        }
+                                        None => Arc::new(RwLock::new(HashMap::new())),
+                                    };
+                                // Drop the write lock
+                                drop(write_state_holder);
+
+                                // lets process the results
+
+                                let read_state_holder = query_state_holder3.read().unwrap();
+                                let (ref query, ref query_data) =
+                                    *(&read_state_holder.query_parsing[query_index]);
+
+                                let res = lines
+                                    .into_iter()
+                                    .enumerate()
+                                    .filter_map(|(line_index, line)| {
+                                        let pattern_match_results2 =
+                                            Arc::clone(&pattern_match_results);
+                                        evaluate_query_on_line(
+                                            query,
+                                            query_data,
+                                            line_index,
+                                            line,
+                                            pattern_match_results2,
+                                        )
+                                    })
+                                    .collect::<Vec<String>>();
+                                drop(read_state_holder);
+
+                                res
+                            })
+                            .take_from_iterable(limit);
+                        Either::A(results)
+                    })
+                    .flatten();
+                Box::new(search_response(body_str, output_shape, gzip_output))
+            },
+        ))
     }
 
     fn process_statement(
@@ -409,8 +445,20 @@ impl Query {
             Statement::Query(ref q) => {
                 match q.body {
                     SetExpr::Select(ref bodyselect) => {
-                        // TODO: Validate a single table
-                        Some(bodyselect.from[0].relation.clone())
+                        // A log maps to a set of files, we can't join them
+                        let tables = tables_in_select(bodyselect);
+                        if tables.len() > 1 {
+                            return Err(multiple_logs_error(&tables));
+                        }
+                        // MinSQL can't evaluate functions, don't read any log for them
+                        let functions = functions_in_select(bodyselect);
+                        if functions.len() > 0 {
+                            return Err(ProcessingQueryError::UnsupportedQuery(format!(
+                                "MinSQL does not support functions; found: {}",
+                                functions.join(", ")
+                            )));
+                        }
+                        tables.into_iter().next()
                     }
                     _ => {
                         return Err(ProcessingQueryError::Fail("No Table Found".to_string()));
@@ -428,7 +476,7 @@ impl Query {
                 "No table was found in the query statement".to_string(),
             ));
         }
-        let log_name = some_table.unwrap().to_string().clone();
+        let log_name = some_table.unwrap();
 
         // check if we have access for the requested table
         let cfg = Arc::clone(&self.config);
@@ -456,17 +504,19 @@ impl Query {
             _ => false,
         };
 
-        let projections = match query {
+        let (projections, qualifiers) = match query {
             Statement::Query(ref q) => {
                 match q.body {
-                    SetExpr::Select(ref bodyselect) => bodyselect.projection.clone(),
+                    SetExpr::Select(ref bodyselect) => {
+                        (bodyselect.projection.clone(), table_qualifiers(bodyselect))
+                    }
                     _ => {
-                        Vec::new() //return empty
+                        (Vec::new(), Vec::new()) //return empty
                     }
                 }
             }
             _ => {
-                Vec::new() //return empty
+                (Vec::new(), Vec::new()) //return empty
             }
         };
 
@@ -474,29 +524,48 @@ impl Query {
         let mut smart_fields: Vec<SmartColumn> = Vec::new();
         let mut smart_fields_set: HashSet<String> = HashSet::new();
         let mut projections_ordered: Vec<String> = Vec::new();
+        // Fields that don't map to a positional or smart field would project nothing
+        let mut unknown_fields: Vec<String> = Vec::new();
         for proj in &projections {
-            match proj {
-                SelectItem::UnnamedExpr(ref ast) => {
-                    // we have an identifier
-                    match detect_field_for_ast(ast) {
-                        FieldFound::PositionalField(positional) => {
-                            projections_ordered.push(positional.alias.clone());
-                            positional_fields.push(positional);
-                        }
-                        FieldFound::SmartField(smart) => {
-                            // we use this set to keep track of active smart fields
-                            smart_fields_set.insert(smart.typed.clone());
-                            // record the order or extraction
-                            projections_ordered.push(smart.alias.clone());
-                            // track the smartfield
-                            smart_fields.push(smart);
-                        }
-                        _ => (),
+            // the field and the name it's projected as, if it was aliased
+            let (ast, alias) = match proj {
+                SelectItem::UnnamedExpr(ref ast) => (ast, None),
+                SelectItem::ExprWithAlias {
+                    ref expr,
+                    ref alias,
+                } => (expr, Some(alias.clone())),
+                _ => continue, // for now let's not do anything on other Variances
+            };
+            // `m.$ip` in `FROM mylog m` is just `$ip`
+            let field = strip_table_qualifier(ast, &qualifiers);
+            match detect_field_for_ast(&field) {
+                FieldFound::PositionalField(mut positional) => {
+                    if let Some(alias) = alias {
+                        positional.alias = alias;
                     }
+                    projections_ordered.push(positional.alias.clone());
+                    positional_fields.push(positional);
+                }
+                FieldFound::SmartField(mut smart) => {
+                    if let Some(alias) = alias {
+                        smart.alias = alias;
+                    }
+                    // we use this set to keep track of active smart fields
+                    smart_fields_set.insert(smart.typed.clone());
+                    // record the order or extraction
+                    projections_ordered.push(smart.alias.clone());
+                    // track the smartfield
+                    smart_fields.push(smart);
                 }
-                _ => {} // for now let's not do anything on other Variances
+                FieldFound::Unknown => unknown_fields.push(ast.to_string()),
             }
         }
+        if unknown_fields.len() > 0 {
+            return Err(ProcessingQueryError::Fail(format!(
+                "Unknown field in projection: {}",
+                unknown_fields.join(", ")
+            )));
+        }
 
         // see which fields in the conditions were not requested in the projections and extract them too
         let limit = match query {
@@ -585,50 +654,16 @@ impl Query {
             .collect()
     }
 
-    /// Reads all the log files for a given `QueryParse` in marked `DataSource`
+    /// Reads all the log files of a log stored in the given `DataStore`
     fn read_logs_from_datastore(
-        cfg: Arc<RwLock<Config>>,
-        query_state_holder: Arc<RwLock<StateHolder>>,
-        query_index: usize,
-        log_ds_index: usize,
+        log_name: String,
+        ds: DataStore,
     ) -> impl Stream<Item = Vec<String>, Error = QueryError> {
-        let cfg_read = cfg.read().unwrap();
-        let read_state_holder = query_state_holder.read().unwrap();
-
-        // Get the `QueryParse` and the `Log` from the indexes provided
-        let q_parse = &read_state_holder.query_parsing[query_index].1;
-        let log = cfg_read.get_log(&q_parse.log_name).unwrap();
-
-        let ds_name = &log.datastores[log_ds_index];
-
-        let log_name = cfg
-            .read()
-            .unwrap()
-            .get_log(&q_parse.log_name)
-            .unwrap()
-            .name
-            .clone()
-            .unwrap();
-        // If the log has a reference to an invalid datastore panic out.
-        let ds = cfg_read.datastore.get(ds_name.as_str()).unwrap();
-        let cfg2 = Arc::clone(&cfg);
-        let query_state_holder2 = Arc::clone(&query_state_holder);
         // Returns Result<(ds, files), error>. Need to stop on error.
         // TODO: Stop on error
         list_msl_bucket_files(log_name.as_str(), &ds)
-            .map(move |obj_key| (query_index.clone(), log_ds_index.clone(), obj_key))
             .map_err(|e| QueryError::Underlying(format!("{:?}", e))) //temporarely remove error, we need to adress this
-            .map(move |(query_index, log_ds_index, obj_key)| {
-                let read_state_holder = query_state_holder2.read().unwrap();
-                let q_parse = &read_state_holder.query_parsing[query_index].1;
-
-                let cfg_read = cfg2.read().unwrap();
-                let log = cfg_read.get_log(&q_parse.log_name).unwrap();
-                drop(read_state_holder);
-
-                let ds_name = &log.datastores[log_ds_index];
-                let ds = cfg_read.datastore.get(ds_name).unwrap();
-
+            .map(move |obj_key| {
                 read_file_line_by_line(&obj_key, &ds)
                     .map_err(|e| QueryError::Underlying(format!("{:?}", e)))
             })
@@ -636,6 +671,395 @@ impl Query {
     }
 }
 
+/// Returns copies of the datastores of a log that need to be read along with their names, `None`
+/// if the log is not present in the configuration. The copies are taken under a single read lock
+/// of the configuration, so a reload while the files are read doesn't affect the search.
+fn log_datastores_to_read(cfg: &Config, log_name: &String) -> Option<Vec<(String, DataStore)>> {
+    let log = cfg.get_log(log_name)?;
+    Some(
+        datastores_to_read(cfg, log)
+            .into_iter()
+            .map(|i| {
+                let ds_name = log.datastores[i].clone();
+                let ds = cfg.datastore[&ds_name].clone();
+                (ds_name, ds)
+            })
+            .collect(),
+    )
+}
+
+/// Returns the indexes of the datastores of a log that need to be read. Datastores missing from
+/// the configuration are skipped, and so are datastores pointing to a bucket that is already
+/// going to be read, otherwise the same files would be returned twice.
+fn datastores_to_read(cfg: &Config, log: &Log) -> Vec<usize> {
+    let mut seen_buckets: HashSet<(String, String)> = HashSet::new();
+    let mut indexes: Vec<usize> = Vec::new();
+    for (i, ds_name) in log.datastores.iter().enumerate() {
+        match cfg.datastore.get(ds_name) {
+            Some(ds) => {
+                if seen_buckets.insert((ds.endpoint.clone(), ds.bucket.clone())) {
+                    indexes.push(i);
+                } else {
+                    info!(
+                        "Skipping datastore `{}` of log `{:?}`, its bucket is already being read.",
+                        &ds_name, &log.name
+                    );
+                }
+            }
+            None => {
+                error!("Log `{:?}` references datastore `{}` which is not present in the configuration.", &log.name, &ds_name);
+            }
+        }
+    }
+    indexes
+}
+
+/// Reads the body of a search request, returns `None` if it's larger than `max_bytes`. Once the
+/// limit is crossed the rest of the body is drained without being kept in memory.
+fn read_query_body(
+    body: Body,
+    max_bytes: usize,
+) -> impl Future<Item = Option<Vec<u8>>, Error = GenericError> {
+    body.from_err::<GenericError>()
+        .fold(Some(Vec::new()), move |acc, chunk| {
+            let acc = acc.and_then(|mut bytes: Vec<u8>| {
+                if bytes.len() + chunk.len() > max_bytes {
+                    None
+                } else {
+                    bytes.extend_from_slice(&chunk);
+                    Some(bytes)
+                }
+            });
+            Ok::<_, GenericError>(acc)
+        })
+}
+
+/// Sends the batches of lines read from a datastore through `tx`. A failure is sent as well and
+/// ends the reading, so the search response reports it instead of silently missing lines.
+fn forward_datastore_lines<S>(
+    lines: S,
+    tx: mpsc::UnboundedSender<Result<Vec<String>, QueryError>>,
+    log_name: String,
+    ds_name: String,
+) -> impl Future<Item = (), Error = ()>
+where
+    S: Stream<Item = Vec<String>, Error = QueryError>,
+{
+    lines
+        .map_err(move |e| {
+            let msg = format!(
+                "Failed reading log `{}` from datastore `{}`: {}",
+                &log_name, &ds_name, e
+            );
+            error!("{}", msg);
+            QueryError::Underlying(msg)
+        })
+        .then(|res| Ok::<_, ()>(res))
+        .fold(tx, |tx, res| {
+            let failed = res.is_err();
+            tx.send(res)
+                .map_err(|_| ())
+                .and_then(move |tx| if failed { Err(()) } else { Ok(tx) })
+        })
+        .map(|_| ())
+}
+
+/// Answers a search once the first batch of results is ready, so a failure before any output is
+/// reported with a 500 instead of an empty 200. A later failure aborts the streamed body.
+fn search_response<S>(
+    results: S,
+    shape: OutputShape,
+    gzip_output: bool,
+) -> impl Future<Item = Response<Body>, Error = GenericError>
+where
+    S: Stream<Item = Vec<String>, Error = QueryError> + Send + 'static,
+{
+    results.into_future().then(move |res| match res {
+        Ok((first, rest)) => {
+            let mut records_written = false;
+            let body = stream::iter_ok(shape.opening())
+                .chain(
+                    stream::iter_ok(first)
+                        .chain(rest)
+                        .map(move |s: Vec<String>| {
+                            Chunk::from(shape.format_records(s, &mut records_written))
+                        }),
+                )
+                .chain(stream::iter_ok(shape.closing()))
+                // batches without records make no output in an array
+                .filter(|chunk: &Chunk| !chunk.is_empty());
+            if gzip_output {
+                let mut response = Response::new(Body::wrap_stream(gzip_chunks(body)));
+                response.headers_mut().insert(
+                    header::CONTENT_ENCODING,
+                    header::HeaderValue::from_static("gzip"),
+                );
+                Ok::<_, GenericError>(response)
+            } else {
+                Ok::<_, GenericError>(Response::new(Body::wrap_stream(body)))
+            }
+        }
+        Err((e, _)) => Ok(return_500(&e.to_string())),
+    })
+}
+
+/// Whether the `Accept-Encoding` header of the request lists gzip, without a `q=0` refusing it.
+fn accepts_gzip(req: &Request<Body>) -> bool {
+    let accept_encoding = match req.headers().get(header::ACCEPT_ENCODING) {
+        Some(val) => val.to_str().unwrap_or(""),
+        None => return false,
+    };
+    accept_encoding.split(',').any(|coding| {
+        let mut params = coding.split(';').map(|p| p.trim());
+        let name = params.next().unwrap_or("");
+        (name == "gzip" || name == "*")
+            && !params.any(|p| p.starts_with("q=") && p[2..].parse::<f32>().ok() == Some(0.0))
+    })
+}
+
+/// Compresses a stream of chunks with gzip. The encoder is flushed after every chunk, so each
+/// batch of results still reaches the client as soon as it's ready.
+fn gzip_chunks<S>(chunks: S) -> impl Stream<Item = Chunk, Error = S::Error>
+where
+    S: Stream<Item = Chunk>,
+{
+    let mut encoder = Some(GzEncoder::new(Vec::new(), Compression::default()));
+    chunks
+        .map(Some)
+        // `None` marks the end of the stream, to write the gzip trailer
+        .chain(stream::iter_ok(vec![None]))
+        .map(move |chunk: Option<Chunk>| {
+            // writing to a `Vec` can't fail
+            match chunk {
+                Some(chunk) => {
+                    let encoder = encoder.as_mut().unwrap();
+                    encoder.write_all(&chunk).unwrap();
+                    encoder.flush().unwrap();
+                    Chunk::from(mem::replace(encoder.get_mut(), Vec::new()))
+                }
+                None => Chunk::from(encoder.take().unwrap().finish().unwrap()),
+            }
+        })
+}
+
+/// Where the SQL text of a search request is located.
+#[derive(Debug)]
+enum QuerySource {
+    // The raw body is the query
+    Raw,
+    // The body is a `SearchRequest` JSON object
+    Json,
+    // The query is in the `query` parameter of the uri query string
+    Parameter(String),
+}
+
+#[derive(Deserialize, Debug)]
+struct SearchRequest {
+    query: String,
+}
+
+/// Extracts the SQL text out of a search request according to its `QuerySource`, returns `None`
+/// if the query couldn't be found.
+fn extract_query_text(source: QuerySource, body: String) -> Option<String> {
+    match source {
+        QuerySource::Raw => Some(body),
+        QuerySource::Json => match serde_json::from_str::<SearchRequest>(&body) {
+            Ok(search_req) => Some(search_req.query),
+            Err(e) => {
+                error!("Could not parse search request: {}", e);
+                None
+            }
+        },
+        QuerySource::Parameter(uri_query) => url::form_urlencoded::parse(uri_query.as_bytes())
+            .find(|(key, _)| key == "query")
+            .map(|(_, value)| value.to_string()),
+    }
+}
+
+/// Layout of the records in the body of a search response.
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum OutputShape {
+    // One JSON object per line
+    Lines,
+    // A single JSON array holding all the records
+    Array,
+}
+
+impl OutputShape {
+    /// Reads the `shape` parameter of the uri query string, defaults to `Lines` and returns
+    /// `None` for an unknown shape.
+    fn from_uri_query(uri_query: &str) -> Option<OutputShape> {
+        match url::form_urlencoded::parse(uri_query.as_bytes()).find(|(key, _)| key == "shape") {
+            Some((_, value)) => match &value[..] {
+                "lines" => Some(OutputShape::Lines),
+                "array" => Some(OutputShape::Array),
+                _ => None,
+            },
+            None => Some(OutputShape::Lines),
+        }
+    }
+
+    fn opening(&self) -> Option<Chunk> {
+        match self {
+            OutputShape::Lines => None,
+            OutputShape::Array => Some(Chunk::from("[")),
+        }
+    }
+
+    fn closing(&self) -> Option<Chunk> {
+        match self {
+            OutputShape::Lines => None,
+            OutputShape::Array => Some(Chunk::from("\n]\n")),
+        }
+    }
+
+    /// Formats a batch of records, `records_written` tracks if any record was sent already so
+    /// the array separators are correct across batches coming from different objects.
+    fn format_records(&self, records: Vec<String>, records_written: &mut bool) -> String {
+        match self {
+            OutputShape::Lines => records.join("\n") + &"\n",
+            OutputShape::Array => {
+                let mut output = String::new();
+                for record in records {
+                    if *records_written {
+                        output.push_str(",\n");
+                    } else {
+                        output.push_str("\n");
+                    }
+                    output.push_str(&record);
+                    *records_written = true;
+                }
+                output
+            }
+        }
+    }
+}
+
+/// Returns the names of the functions used in the projections or conditions of a select.
+fn functions_in_select(select: &Select) -> Vec<String> {
+    let mut functions: Vec<String> = Vec::new();
+    for projection in &select.projection {
+        match projection {
+            SelectItem::UnnamedExpr(ref expr) => collect_functions(expr, &mut functions),
+            SelectItem::ExprWithAlias { ref expr, .. } => collect_functions(expr, &mut functions),
+            _ => {}
+        }
+    }
+    if let Some(ref selection) = select.selection {
+        collect_functions(selection, &mut functions);
+    }
+    functions
+}
+
+fn collect_functions(ast_node: &Expr, functions: &mut Vec<String>) {
+    match ast_node {
+        Expr::Function(function) => {
+            functions.push(function.name.to_string());
+            for arg in &function.args {
+                collect_functions(arg, functions);
+            }
+        }
+        Expr::Nested(nested_ast) => collect_functions(nested_ast, functions),
+        Expr::IsNull(ast) | Expr::IsNotNull(ast) => collect_functions(ast, functions),
+        Expr::UnaryOp { expr, .. } | Expr::Cast { expr, .. } => collect_functions(expr, functions),
+        Expr::BinaryOp { left, right, .. } => {
+            collect_functions(left, functions);
+            collect_functions(right, functions);
+        }
+        Expr::Between {
+            expr, low, high, ..
+        } => {
+            collect_functions(expr, functions);
+            collect_functions(low, functions);
+            collect_functions(high, functions);
+        }
+        Expr::InList { expr, list, .. } => {
+            collect_functions(expr, functions);
+            for item in list {
+                collect_functions(item, functions);
+            }
+        }
+        Expr::Case {
+            operand,
+            conditions,
+            results,
+            else_result,
+        } => {
+            if let Some(operand) = operand {
+                collect_functions(operand, functions);
+            }
+            for item in conditions.iter().chain(results.iter()) {
+                collect_functions(item, functions);
+            }
+            if let Some(else_result) = else_result {
+                collect_functions(else_result, functions);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// A log maps to a set of files, so queries over several logs can't be executed.
+fn multiple_logs_error(tables: &Vec<String>) -> ProcessingQueryError {
+    ProcessingQueryError::UnsupportedQuery(format!(
+        "MinSQL supports a single log per query; found: {}",
+        tables.join(", ")
+    ))
+}
+
+/// Returns the names of all the tables referenced in the `FROM` of a select, including the ones
+/// brought in via joins.
+fn tables_in_select(select: &Select) -> Vec<String> {
+    let mut tables: Vec<String> = Vec::new();
+    for table_with_joins in &select.from {
+        tables.push(table_name(&table_with_joins.relation));
+        for join in &table_with_joins.joins {
+            tables.push(table_name(&join.relation));
+        }
+    }
+    tables
+}
+
+/// Name of a table in the `FROM` of a select, without its alias.
+fn table_name(relation: &TableFactor) -> String {
+    match relation {
+        TableFactor::Table { name, .. } => name.to_string(),
+        _ => relation.to_string(),
+    }
+}
+
+/// Returns the names a field of the select can be qualified with, that is the table names and
+/// their aliases.
+fn table_qualifiers(select: &Select) -> Vec<String> {
+    let mut qualifiers: Vec<String> = Vec::new();
+    for table_with_joins in &select.from {
+        if let TableFactor::Table { name, alias, .. } = &table_with_joins.relation {
+            qualifiers.push(name.to_string());
+            if let Some(alias) = alias {
+                qualifiers.push(alias.to_string());
+            }
+        }
+    }
+    qualifiers
+}
+
+/// Removes the table qualifier of a field, `m.$ip` becomes `$ip` when `m` is one of the
+/// `qualifiers`.
+fn strip_table_qualifier(ast: &Expr, qualifiers: &Vec<String>) -> Expr {
+    match ast {
+        Expr::CompoundIdentifier(ref identifier)
+            if identifier.len() > 1 && qualifiers.contains(&identifier[0]) =>
+        {
+            if identifier.len() == 2 {
+                Expr::Identifier(identifier[1].clone())
+            } else {
+                Expr::CompoundIdentifier(identifier[1..].to_vec())
+            }
+        }
+        _ => ast.clone(),
+    }
+}
+
 fn process_fields_for_ast(
     ast_node: &Expr,
     positional_fields: &mut Vec<PositionalColumn>,
@@ -1163,7 +1587,9 @@ fn build_meta_extras(
 
 #[cfg(test)]
 mod query_tests {
-    use crate::config::{Config, Log, LogAuth, Server, Token};
+    use hyper::StatusCode;
+
+    use crate::config::{Config, DataStore, Log, LogAuth, Server, Token};
 
     use super::*;
 
@@ -1218,6 +1644,9 @@ mod query_tests {
                 secret_key: "".to_string(),
                 pkcs12_cert: None,
                 pkcs12_password: None,
+                max_query_bytes: 10485760,
+                disable_webui: false,
+                max_concurrent_ingests: 0,
             },
             datastore: HashMap::new(),
             tokens: tokens,
@@ -1541,6 +1970,337 @@ mod query_tests {
         }
     }
 
+    #[test]
+    fn validate_join_with_missing_log() {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        // `otherlog` isn't configured, the single log error still takes precedence
+        let ast = query_c
+            .parse_query("SELECT * FROM mylog CROSS JOIN otherlog".to_string())
+            .unwrap();
+        match query_c.validate_logs(&ast) {
+            Some(ProcessingQueryError::UnsupportedQuery(s)) => assert_eq!(
+                s,
+                "MinSQL supports a single log per query; found: mylog, otherlog"
+            ),
+            other => panic!("Incorrect validation result: {:?}", other),
+        }
+    }
+
+    #[test]
+    fn validate_comma_tables_with_missing_log() {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c
+            .parse_query("SELECT * FROM mylog, otherlog".to_string())
+            .unwrap();
+        match query_c.validate_logs(&ast) {
+            Some(ProcessingQueryError::UnsupportedQuery(s)) => assert_eq!(
+                s,
+                "MinSQL supports a single log per query; found: mylog, otherlog"
+            ),
+            other => panic!("Incorrect validation result: {:?}", other),
+        }
+    }
+
+    #[test]
+    fn datastores_to_read_for_removed_log() {
+        let access_token = VALID_TOKEN.to_string();
+
+        let mut cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        assert_eq!(
+            log_datastores_to_read(&cfg, &"mylog".to_string()),
+            Some(Vec::new())
+        );
+        // the log is removed after the query was validated
+        cfg.log.remove("mylog");
+        assert_eq!(log_datastores_to_read(&cfg, &"mylog".to_string()), None);
+    }
+
+    fn run_multiple_tables_case(query: &str) {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c.parse_query(query.to_string()).unwrap();
+        match query_c.process_sql(&access_token, ast, false) {
+            Ok(_) => panic!("Query over multiple logs should have failed"),
+            Err(ProcessingQueryError::UnsupportedQuery(s)) => assert_eq!(
+                s,
+                "MinSQL supports a single log per query; found: mylog, otherlog"
+            ),
+            Err(e) => panic!("Incorrect error: {:?}", e),
+        }
+    }
+
+    #[test]
+    fn process_select_join_rejected() {
+        run_multiple_tables_case("SELECT * FROM mylog CROSS JOIN otherlog");
+    }
+
+    #[test]
+    fn process_select_comma_tables_rejected() {
+        run_multiple_tables_case("SELECT * FROM mylog, otherlog");
+    }
+
+    fn run_unsupported_function_case(query: &str, expected: &str) {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c.parse_query(query.to_string()).unwrap();
+        match query_c.process_sql(&access_token, ast, false) {
+            Ok(_) => panic!("Query with a function should have failed"),
+            Err(ProcessingQueryError::UnsupportedQuery(s)) => assert_eq!(s, expected),
+            Err(e) => panic!("Incorrect error: {:?}", e),
+        }
+    }
+
+    #[test]
+    fn process_unsupported_function_in_projection() {
+        run_unsupported_function_case(
+            "SELECT COUNT($ip) FROM mylog",
+            "MinSQL does not support functions; found: COUNT",
+        );
+    }
+
+    #[test]
+    fn process_unsupported_function_in_condition() {
+        run_unsupported_function_case(
+            "SELECT $ip FROM mylog WHERE LOWER($email) = 'a@b.com'",
+            "MinSQL does not support functions; found: LOWER",
+        );
+    }
+
+    #[test]
+    fn process_function_in_between() {
+        run_unsupported_function_case(
+            "SELECT $ip FROM mylog WHERE $1 BETWEEN LOWER($2) AND 'z'",
+            "MinSQL does not support functions; found: LOWER",
+        );
+    }
+
+    #[test]
+    fn process_function_in_list() {
+        run_unsupported_function_case(
+            "SELECT $ip FROM mylog WHERE $1 IN ('a', UPPER($2))",
+            "MinSQL does not support functions; found: UPPER",
+        );
+    }
+
+    #[test]
+    fn process_function_in_cast() {
+        run_unsupported_function_case(
+            "SELECT CAST(LENGTH($1) AS TEXT) FROM mylog",
+            "MinSQL does not support functions; found: LENGTH",
+        );
+    }
+
+    #[test]
+    fn process_function_in_unary_op() {
+        run_unsupported_function_case(
+            "SELECT $ip FROM mylog WHERE NOT ISEMPTY($1)",
+            "MinSQL does not support functions; found: ISEMPTY",
+        );
+    }
+
+    #[test]
+    fn process_query_without_functions() {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c
+            .parse_query("SELECT $ip FROM mylog WHERE $email = 'a@b.com'".to_string())
+            .unwrap();
+        assert!(query_c.process_sql(&access_token, ast, false).is_ok());
+    }
+
+    fn run_projection_case(query: &str) -> Result<(), String> {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c.parse_query(query.to_string()).unwrap();
+        match query_c.process_sql(&access_token, ast, false) {
+            Ok(_) => Ok(()),
+            Err(ProcessingQueryError::Fail(s)) => Err(s),
+            Err(e) => panic!("Incorrect error: {:?}", e),
+        }
+    }
+
+    #[test]
+    fn process_known_projections() {
+        assert_eq!(
+            run_projection_case("SELECT $1, $ip, $user_agent.name FROM mylog"),
+            Ok(())
+        );
+    }
+
+    #[test]
+    fn process_unknown_projections_rejected() {
+        assert_eq!(
+            run_projection_case("SELECT $ip, nonexistent, s.col FROM mylog"),
+            Err("Unknown field in projection: nonexistent, s.col".to_string())
+        );
+    }
+
+    #[test]
+    fn process_unknown_aliased_projection_rejected() {
+        assert_eq!(
+            run_projection_case("SELECT nonexistent AS n FROM mylog"),
+            Err("Unknown field in projection: nonexistent".to_string())
+        );
+    }
+
+    fn projections_for(query: &str) -> QueryParsing {
+        let access_token = VALID_TOKEN.to_string();
+
+        let cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let cfg = Arc::new(RwLock::new(cfg));
+        let query_c = Query::new(cfg);
+
+        let ast = query_c.parse_query(query.to_string()).unwrap();
+        let mut parsed = query_c.process_sql(&access_token, ast, false).unwrap();
+        parsed.remove(0).1
+    }
+
+    #[test]
+    fn process_aliased_projections() {
+        let q_parse = projections_for("SELECT $ip AS addr, $2 AS second FROM mylog");
+        assert_eq!(
+            q_parse.projections_ordered,
+            vec!["addr".to_string(), "second".to_string()]
+        );
+        assert_eq!(q_parse.smart_fields[0].typed, "ip");
+        assert_eq!(q_parse.smart_fields[0].alias, "addr");
+        assert_eq!(q_parse.positional_fields[0].position, 2);
+        assert_eq!(q_parse.positional_fields[0].alias, "second");
+    }
+
+    #[test]
+    fn process_table_qualified_projections() {
+        let q_parse = projections_for("SELECT m.$ip, m.$user_agent.name, mylog.$1 FROM mylog m");
+        assert_eq!(q_parse.log_name, "mylog");
+        assert_eq!(
+            q_parse.projections_ordered,
+            vec![
+                "$ip".to_string(),
+                "$user_agent.name".to_string(),
+                "$1".to_string()
+            ]
+        );
+        assert_eq!(q_parse.smart_fields[1].subfield, Some("name".to_string()));
+        assert_eq!(q_parse.positional_fields[0].position, 1);
+    }
+
+    fn datastore_for(name: &str, endpoint: &str, bucket: &str) -> DataStore {
+        DataStore {
+            name: Some(name.to_string()),
+            endpoint: endpoint.to_string(),
+            access_key: "".to_string(),
+            secret_key: "".to_string(),
+            bucket: bucket.to_string(),
+            prefix: "".to_string(),
+            region: None,
+            sse: None,
+            sse_kms_key_id: None,
+            auto_create_bucket: false,
+            stored: None,
+        }
+    }
+
+    #[test]
+    fn overlapping_datastores_read_once() {
+        let access_token = VALID_TOKEN.to_string();
+        let mut cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let datastores = vec![
+            datastore_for("ds1", "http://localhost:9000", "logs"),
+            datastore_for("ds2", "http://localhost:9000", "logs"),
+            datastore_for("ds3", "http://localhost:9000", "other-logs"),
+        ];
+        for ds in datastores {
+            cfg.datastore.insert(ds.name.clone().unwrap(), ds);
+        }
+        let log = Log {
+            name: Some("mylog".to_string()),
+            datastores: vec![
+                "ds1".to_string(),
+                "ds2".to_string(),
+                "ds3".to_string(),
+                "missing".to_string(),
+            ],
+            commit_window: "5s".to_string(),
+        };
+
+        assert_eq!(datastores_to_read(&cfg, &log), vec![0, 2]);
+    }
+
+    #[test]
+    fn datastores_to_read_are_copies() {
+        let access_token = VALID_TOKEN.to_string();
+        let mut cfg = get_ds_log_auth_config_for("mylog".to_string(), &access_token);
+        let ds = datastore_for("ds1", "http://localhost:9000", "logs");
+        cfg.datastore.insert("ds1".to_string(), ds.clone());
+        cfg.log.get_mut("mylog").unwrap().datastores = vec!["ds1".to_string(), "gone".to_string()];
+
+        let to_read = log_datastores_to_read(&cfg, &"mylog".to_string());
+        // a reload of the configuration doesn't change what is read
+        cfg.datastore.remove("ds1");
+        assert_eq!(to_read, Some(vec![("ds1".to_string(), ds)]));
+        assert_eq!(log_datastores_to_read(&cfg, &"other".to_string()), None);
+    }
+
+    #[test]
+    fn extract_query_from_raw_body() {
+        let query = extract_query_text(QuerySource::Raw, "SELECT * FROM mylog".to_string());
+        assert_eq!(query, Some("SELECT * FROM mylog".to_string()));
+    }
+
+    #[test]
+    fn extract_query_from_json_body() {
+        let body = r#"{"query":"SELECT * FROM mylog"}"#.to_string();
+        let query = extract_query_text(QuerySource::Json, body);
+        assert_eq!(query, Some("SELECT * FROM mylog".to_string()));
+    }
+
+    #[test]
+    fn extract_query_from_invalid_json_body() {
+        let body = r#"{"sql":"SELECT * FROM mylog"}"#.to_string();
+        let query = extract_query_text(QuerySource::Json, body);
+        assert_eq!(query, None);
+    }
+
+    #[test]
+    fn extract_query_from_parameter() {
+        let uri_query = "query=SELECT+*+FROM+mylog%20LIMIT%2010".to_string();
+        let query = extract_query_text(QuerySource::Parameter(uri_query), "".to_string());
+        assert_eq!(query, Some("SELECT * FROM mylog LIMIT 10".to_string()));
+    }
+
+    #[test]
+    fn extract_query_from_missing_parameter() {
+        let uri_query = "limit=10".to_string();
+        let query = extract_query_text(QuerySource::Parameter(uri_query), "".to_string());
+        assert_eq!(query, None);
+    }
+
     struct ParseMatchTestCase {
         log_name: String,
         query: String,
@@ -1634,4 +2394,174 @@ mod query_tests {
         };
         run_parse_and_match_case(tc);
     }
+
+    #[test]
+    fn output_shape_from_uri_query() {
+        assert_eq!(OutputShape::from_uri_query(""), Some(OutputShape::Lines));
+        assert_eq!(
+            OutputShape::from_uri_query("shape=lines"),
+            Some(OutputShape::Lines)
+        );
+        assert_eq!(
+            OutputShape::from_uri_query("query=SELECT&shape=array"),
+            Some(OutputShape::Array)
+        );
+        assert_eq!(OutputShape::from_uri_query("shape=csv"), None);
+    }
+
+    // Formats the batches the way the search body stream does
+    fn format_batches(shape: OutputShape, batches: Vec<Vec<&str>>) -> String {
+        let mut records_written = false;
+        let mut output = String::new();
+        if let Some(chunk) = shape.opening() {
+            output.push_str(std::str::from_utf8(&chunk).unwrap());
+        }
+        for batch in batches {
+            let records = batch.into_iter().map(|r| r.to_string()).collect();
+            output.push_str(&shape.format_records(records, &mut records_written));
+        }
+        if let Some(chunk) = shape.closing() {
+            output.push_str(std::str::from_utf8(&chunk).unwrap());
+        }
+        output
+    }
+
+    #[test]
+    fn array_output_is_one_json_array() {
+        let output = format_batches(
+            OutputShape::Array,
+            vec![
+                vec![r#"{"$ip":"1.1.1.1"}"#, r#"{"$ip":"2.2.2.2"}"#],
+                vec![],
+                vec![r#"{"$ip":"3.3.3.3"}"#],
+            ],
+        );
+        let records: Vec<serde_json::Value> = serde_json::from_str(&output).unwrap();
+        assert_eq!(records.len(), 3);
+        assert_eq!(records[2]["$ip"], "3.3.3.3");
+    }
+
+    #[test]
+    fn empty_array_output() {
+        let output = format_batches(OutputShape::Array, vec![vec![]]);
+        let records: Vec<serde_json::Value> = serde_json::from_str(&output).unwrap();
+        assert_eq!(records.len(), 0);
+    }
+
+    #[test]
+    fn lines_output() {
+        let output = format_batches(
+            OutputShape::Lines,
+            vec![vec![r#"{"$ip":"1.1.1.1"}"#, r#"{"$ip":"2.2.2.2"}"#]],
+        );
+        assert_eq!(output, "{\"$ip\":\"1.1.1.1\"}\n{\"$ip\":\"2.2.2.2\"}\n");
+    }
+
+    #[test]
+    fn query_body_at_size_limit() {
+        let body = Body::from("a".repeat(10));
+        assert_eq!(
+            read_query_body(body, 10).wait().unwrap(),
+            Some("a".repeat(10).into_bytes())
+        );
+    }
+
+    #[test]
+    fn query_body_over_size_limit() {
+        let body = Body::from("a".repeat(11));
+        assert_eq!(read_query_body(body, 10).wait().unwrap(), None);
+    }
+
+    // Runs the lines of a single datastore through the search channel and builds the response
+    fn run_datastore_search(lines: Vec<Result<Vec<String>, QueryError>>) -> Response<Body> {
+        let (tx, rx) = mpsc::unbounded_channel::<Result<Vec<String>, QueryError>>();
+        // the forwarding fails when the datastore fails, the error goes through the channel
+        let _ = forward_datastore_lines(
+            stream::iter_result(lines),
+            tx,
+            "mylog".to_string(),
+            "ds1".to_string(),
+        )
+        .wait();
+        let results = rx
+            .map_err(|e| QueryError::Underlying(format!("{:?}", e)))
+            .and_then(|lines| lines);
+        search_response(results, OutputShape::Lines, false)
+            .wait()
+            .unwrap()
+    }
+
+    #[test]
+    fn failing_datastore_before_output() {
+        let resp = run_datastore_search(vec![Err(QueryError::Underlying(
+            "Access Denied".to_string(),
+        ))]);
+        assert_eq!(resp.status(), StatusCode::INTERNAL_SERVER_ERROR);
+        let body = resp.into_body().concat2().wait().unwrap();
+        let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(
+            payload["error"],
+            "Failed reading log `mylog` from datastore `ds1`: Access Denied"
+        );
+    }
+
+    #[test]
+    fn failing_datastore_mid_stream() {
+        let resp = run_datastore_search(vec![
+            Ok(vec![r#"{"$ip":"1.1.1.1"}"#.to_string()]),
+            Err(QueryError::Underlying("Connection reset".to_string())),
+        ]);
+        // the status is already sent, the body must not end as if it was complete
+        assert_eq!(resp.status(), StatusCode::OK);
+        assert!(resp.into_body().concat2().wait().is_err());
+    }
+
+    #[test]
+    fn datastore_search_without_failures() {
+        let resp = run_datastore_search(vec![Ok(vec![r#"{"$ip":"1.1.1.1"}"#.to_string()])]);
+        assert_eq!(resp.status(), StatusCode::OK);
+        let body = resp.into_body().concat2().wait().unwrap();
+        assert_eq!(&body[..], &b"{\"$ip\":\"1.1.1.1\"}\n"[..]);
+    }
+
+    fn request_accepting(accept_encoding: &str) -> Request<Body> {
+        Request::builder()
+            .uri("/search")
+            .header("Accept-Encoding", accept_encoding)
+            .body(Body::empty())
+            .unwrap()
+    }
+
+    #[test]
+    fn accepted_encodings() {
+        assert!(accepts_gzip(&request_accepting("gzip")));
+        assert!(accepts_gzip(&request_accepting("deflate, gzip;q=0.5")));
+        assert!(accepts_gzip(&request_accepting("*")));
+        assert!(!accepts_gzip(&request_accepting("gzip;q=0")));
+        assert!(!accepts_gzip(&request_accepting("deflate, br")));
+        assert!(!accepts_gzip(&Request::new(Body::empty())));
+    }
+
+    #[test]
+    fn gzip_chunks_are_flushed() {
+        use std::io::Read;
+
+        let chunks = vec![Chunk::from("first\n"), Chunk::from("second\n")];
+        let compressed: Vec<Chunk> = gzip_chunks(stream::iter_ok::<_, ()>(chunks))
+            .collect()
+            .wait()
+            .unwrap();
+        // every chunk plus the trailer
+        assert_eq!(compressed.len(), 3);
+        // the first chunk can be decompressed before the rest arrives
+        let mut first = String::new();
+        let _ = flate2::read::GzDecoder::new(&compressed[0][..]).read_to_string(&mut first);
+        assert_eq!(first, "first\n");
+        let all: Vec<u8> = compressed.iter().flat_map(|c| c.to_vec()).collect();
+        let mut decoded = String::new();
+        flate2::read::GzDecoder::new(&all[..])
+            .read_to_string(&mut decoded)
+            .unwrap();
+        assert_eq!(decoded, "first\nsecond\n");
+    }
 }
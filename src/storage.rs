@@ -19,9 +19,10 @@ use std::fmt;
 use std::sync::{Arc, RwLock};
 use std::time::Instant;
 
-use chrono::{Datelike, Timelike, Utc};
+use chrono::{DateTime, Datelike, Timelike, Utc};
 use futures::future::result;
 use futures::future::FutureResult;
+use futures::future::{err, Either};
 use futures::Poll;
 use futures::{stream, Future, Stream};
 use log::error;
@@ -33,8 +34,9 @@ use rusoto_credential::AwsCredentials;
 use rusoto_credential::CredentialsError;
 use rusoto_credential::ProvideAwsCredentials;
 use rusoto_s3::{
-    DeleteObjectOutput, DeleteObjectRequest, GetObjectRequest, ListObjectsRequest, PutObjectOutput,
-    PutObjectRequest, S3Client, S3,
+    CreateBucketConfiguration, CreateBucketOutput, CreateBucketRequest, DeleteObjectOutput,
+    DeleteObjectRequest, GetObjectRequest, ListObjectsRequest, PutObjectOutput, PutObjectRequest,
+    S3Client, S3,
 };
 use tokio_codec::{FramedRead, LinesCodec};
 use uuid::Uuid;
@@ -131,13 +133,21 @@ pub fn client_for_datastore(datastore: &DataStore) -> S3Client {
     );
     let provider = CustomCredentialsProvider::with_credentials(credentials);
     let dispatcher = HttpClient::new().expect("failed to create request dispatcher");
-    // A custom region is the way to point to a minio instance
-    let region = Region::Custom {
-        name: datastore.name.clone().unwrap(),
-        endpoint: datastore.endpoint.clone(),
-    };
     // Build the client
-    S3Client::new_with(dispatcher, provider, region)
+    S3Client::new_with(dispatcher, provider, region_for_datastore(datastore))
+}
+
+/// A custom region is the way to point to a minio instance, the region name is the one
+/// configured on the datastore, or the datastore name if none is set.
+fn region_for_datastore(datastore: &DataStore) -> Region {
+    let name = match &datastore.region {
+        Some(region) if region != "" => region.clone(),
+        _ => datastore.name.clone().unwrap(),
+    };
+    Region::Custom {
+        name: name,
+        endpoint: datastore.endpoint.clone(),
+    }
 }
 
 #[derive(Debug)]
@@ -179,46 +189,95 @@ pub fn can_reach_datastore(
         .unwrap_or(Ok(false))
 }
 
+#[derive(Debug)]
+pub enum CreateBucketError {
+    Create(String),
+}
+
+/// Creates the bucket for a datastore, a bucket we already own is not considered an error.
+pub fn create_datastore_bucket(
+    datastore: &DataStore,
+) -> impl Future<Item = (), Error = StorageError<CreateBucketError>> {
+    let s3_client = client_for_datastore(datastore);
+    create_bucket_with(datastore, move |input| s3_client.create_bucket(input))
+}
+
+/// Issues the request to create the bucket of a datastore through `create_bucket`, which performs
+/// the actual call to the Object Storage.
+pub fn create_bucket_with<F, R>(
+    datastore: &DataStore,
+    create_bucket: F,
+) -> impl Future<Item = (), Error = StorageError<CreateBucketError>>
+where
+    F: FnOnce(CreateBucketRequest) -> R,
+    R: Future<Item = CreateBucketOutput, Error = RusotoError<rusoto_s3::CreateBucketError>>,
+{
+    // Buckets outside the default region need to say where they go, S3 rejects the default
+    // region as a location constraint
+    let create_bucket_configuration = match &datastore.region {
+        Some(region) if region != "" && region != "us-east-1" => Some(CreateBucketConfiguration {
+            location_constraint: Some(region.clone()),
+        }),
+        _ => None,
+    };
+    create_bucket(CreateBucketRequest {
+        bucket: datastore.bucket.clone(),
+        create_bucket_configuration: create_bucket_configuration,
+        ..Default::default()
+    })
+    .map(|_| ())
+    .or_else(|e| match e {
+        RusotoError::Service(rusoto_s3::CreateBucketError::BucketAlreadyOwnedByYou(_)) => Ok(()),
+        e => Err(StorageError::Operation(CreateBucketError::Create(format!(
+            "Could not create bucket: {}",
+            e
+        )))),
+    })
+}
+
 #[derive(Debug)]
 pub enum PutObjectError {
     Write(String),
 }
 
+/// Writes the payload of a log to the datastore named `datastore_name`, or to one of the
+/// datastores of the log picked at random if `None`. A write with an `idempotency_key` replaces
+/// the object of an earlier write with the same key, see `object_name_for`.
 pub fn write_to_datastore(
     cfg: Arc<RwLock<Config>>,
     log_name: &str,
+    datastore_name: Option<&str>,
+    idempotency_key: Option<&str>,
     payload: Vec<String>,
     length: i64,
 ) -> impl Future<Item = (), Error = StorageError<PutObjectError>> {
     let start = Instant::now();
     let read_cfg = cfg.read().unwrap();
-    // Select a datastore at random to write to
-    let datastore = rand_datastore(&read_cfg, &log_name).unwrap();
+    let datastore = match select_datastore(&read_cfg, &log_name, datastore_name, idempotency_key) {
+        Some(ds) => ds,
+        None => {
+            return Either::B(err(StorageError::Operation(PutObjectError::Write(
+                format!("No datastore available to write log `{}`", log_name),
+            ))));
+        }
+    };
     // Get the Object Storage client
     let s3_client = client_for_datastore(&datastore);
     // Prepare the name of the log
-    let now = Utc::now();
-    let my_uuid = Uuid::new_v4();
-    let target_file = format!(
-        "{log}/{year}/{month}/{day}/{hour}/{ts}.log",
-        log = log_name,
-        year = now.date().year(),
-        month = now.date().month(),
-        day = now.date().day(),
-        hour = now.hour(),
-        ts = my_uuid
-    );
-    let destination = format!("minsql/{}", target_file);
+    let destination = object_name_for(log_name, Utc::now(), idempotency_key);
     // turn the payload into a streaming body
     let stream_of_bytes = stream::iter_ok(payload).map(|s| Bytes::from(s.into_bytes()));
     let streaming_body = rusoto_s3::StreamingBody::new(stream_of_bytes);
+    let (server_side_encryption, ssekms_key_id) = sse_for_datastore(&datastore);
     // save the payload
-    s3_client
+    let write = s3_client
         .put_object(PutObjectRequest {
             bucket: datastore.bucket.clone(),
             key: destination,
             body: Some(streaming_body),
             content_length: Some(length),
+            server_side_encryption,
+            ssekms_key_id,
             ..Default::default()
         })
         .map_err(|e| {
@@ -231,7 +290,41 @@ pub fn write_to_datastore(
             //TODO: Remove this metric
             let duration = start.elapsed();
             println!("Writing to minio: {:?}", duration);
-        })
+        });
+    Either::A(write)
+}
+
+/// Name of the object holding a write of `log_name` made at `now`. Writes with an
+/// `idempotency_key` are named after it instead of a random UUID, so a retry made within the same
+/// hour overwrites the object rather than duplicating its lines.
+fn object_name_for(log_name: &str, now: DateTime<Utc>, idempotency_key: Option<&str>) -> String {
+    let name = match idempotency_key {
+        // hashed, the key could have characters that aren't valid in an object name
+        Some(key) => format!("{:x}", md5::compute(key)),
+        None => Uuid::new_v4().to_string(),
+    };
+    format!(
+        "minsql/{log}/{year}/{month}/{day}/{hour}/{name}.log",
+        log = log_name,
+        year = now.date().year(),
+        month = now.date().month(),
+        day = now.date().day(),
+        hour = now.hour(),
+        name = name
+    )
+}
+
+/// Returns the `server_side_encryption` and `ssekms_key_id` values to send when writing objects
+/// to the datastore, according to its `sse` setting.
+fn sse_for_datastore(datastore: &DataStore) -> (Option<String>, Option<String>) {
+    match datastore.sse.as_ref().map(|s| &s[..]) {
+        Some("s3") => (Some("AES256".to_string()), None),
+        Some("kms") => (
+            Some("aws:kms".to_string()),
+            datastore.sse_kms_key_id.clone(),
+        ),
+        _ => (None, None),
+    }
 }
 
 pub fn put_object_metabucket(
@@ -366,13 +459,49 @@ pub fn read_file_line_by_line(
         .flatten_stream()
 }
 
+/// Returns the datastore of the log named `datastore_name`, or one at random if `None`. Writes
+/// with an `idempotency_key` always go to the same datastore, so retries land on the same object.
+fn select_datastore<'a>(
+    cfg: &'a Config,
+    log_name: &str,
+    datastore_name: Option<&str>,
+    idempotency_key: Option<&str>,
+) -> Option<&'a DataStore> {
+    match (datastore_name, idempotency_key) {
+        (Some(name), _) => cfg
+            .log
+            .get(log_name)
+            .filter(|log| log.datastores.iter().any(|ds_name| ds_name == name))
+            .and_then(|_| cfg.datastore.get(name)),
+        (None, Some(key)) => cfg
+            .log
+            .get(log_name)
+            .and_then(|log| {
+                let n = log.datastores.len();
+                if n == 0 {
+                    return None;
+                }
+                let digest = md5::compute(key);
+                let i = digest[..4]
+                    .iter()
+                    .fold(0usize, |acc, b| (acc << 8) | *b as usize);
+                log.datastores.get(i % n)
+            })
+            .and_then(|name| cfg.datastore.get(&name[..])),
+        (None, None) => rand_datastore(cfg, log_name),
+    }
+}
+
 /// Selects a datastore at random. Will return `None` if the log_name
-/// doesn't match a valid `Log` name in the `Config`.
+/// doesn't match a valid `Log` name in the `Config` or the log has no datastores.
 fn rand_datastore<'a>(cfg: &'a Config, log_name: &str) -> Option<&'a DataStore> {
     cfg.log
         .get(log_name)
         .and_then(|log| {
             let n = log.datastores.len();
+            if n == 0 {
+                return None;
+            }
             let mut rng = rand::thread_rng();
             let i = rng.gen_range(0, n);
             log.datastores.iter().skip(i).next()
@@ -401,6 +530,11 @@ mod storage_tests {
                     secret_key: "".to_string(),
                     bucket: "".to_string(),
                     prefix: "".to_string(),
+                    region: None,
+                    sse: None,
+                    sse_kms_key_id: None,
+                    auto_create_bucket: false,
+                    stored: None,
                 },
             );
         }
@@ -424,6 +558,9 @@ mod storage_tests {
                 secret_key: "".to_string(),
                 pkcs12_cert: None,
                 pkcs12_password: None,
+                max_query_bytes: 10485760,
+                disable_webui: false,
+                max_concurrent_ingests: 0,
             },
             datastore: datastore_map,
             tokens: HashMap::new(),
@@ -449,6 +586,232 @@ mod storage_tests {
         assert_eq!(ds_in_list, true)
     }
 
+    #[test]
+    fn sse_s3_datastore() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get_mut("ds1").unwrap();
+        ds.sse = Some("s3".to_string());
+
+        assert_eq!(sse_for_datastore(ds), (Some("AES256".to_string()), None));
+    }
+
+    #[test]
+    fn sse_kms_datastore() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get_mut("ds1").unwrap();
+        ds.sse = Some("kms".to_string());
+        ds.sse_kms_key_id = Some("my-key".to_string());
+
+        assert_eq!(
+            sse_for_datastore(ds),
+            (Some("aws:kms".to_string()), Some("my-key".to_string()))
+        );
+    }
+
+    #[test]
+    fn no_sse_datastore() {
+        let ds_list = vec!["ds1".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get("ds1").unwrap();
+
+        assert_eq!(sse_for_datastore(ds), (None, None));
+    }
+
+    #[test]
+    fn datastore_region_propagated() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get_mut("ds1").unwrap();
+        ds.region = Some("eu-west-1".to_string());
+
+        assert_eq!(
+            region_for_datastore(ds),
+            Region::Custom {
+                name: "eu-west-1".to_string(),
+                endpoint: ds.endpoint.clone(),
+            }
+        );
+    }
+
+    #[test]
+    fn datastore_without_region() {
+        let ds_list = vec!["ds1".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get("ds1").unwrap();
+
+        assert_eq!(
+            region_for_datastore(ds),
+            Region::Custom {
+                name: "ds1".to_string(),
+                endpoint: ds.endpoint.clone(),
+            }
+        );
+    }
+
+    #[test]
+    fn bucket_creation_requested() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get_mut("ds1").unwrap();
+        ds.bucket = "mybucket".to_string();
+        ds.region = Some("eu-west-1".to_string());
+
+        let mut requests: Vec<CreateBucketRequest> = Vec::new();
+        let res = create_bucket_with(ds, |input| {
+            requests.push(input);
+            result(Ok(CreateBucketOutput::default()))
+        })
+        .wait();
+
+        assert!(res.is_ok());
+        assert_eq!(requests.len(), 1);
+        assert_eq!(requests[0].bucket, "mybucket");
+        assert_eq!(
+            requests[0].create_bucket_configuration,
+            Some(CreateBucketConfiguration {
+                location_constraint: Some("eu-west-1".to_string()),
+            })
+        );
+    }
+
+    #[test]
+    fn bucket_creation_without_region() {
+        let ds_list = vec!["ds1".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get("ds1").unwrap();
+
+        let mut requests: Vec<CreateBucketRequest> = Vec::new();
+        let res = create_bucket_with(ds, |input| {
+            requests.push(input);
+            result(Ok(CreateBucketOutput::default()))
+        })
+        .wait();
+
+        assert!(res.is_ok());
+        assert_eq!(requests[0].create_bucket_configuration, None);
+    }
+
+    #[test]
+    fn bucket_creation_in_default_region() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get_mut("ds1").unwrap();
+
+        for region in &["us-east-1", ""] {
+            ds.region = Some(region.to_string());
+            let mut requests: Vec<CreateBucketRequest> = Vec::new();
+            let res = create_bucket_with(ds, |input| {
+                requests.push(input);
+                result(Ok(CreateBucketOutput::default()))
+            })
+            .wait();
+
+            assert!(res.is_ok());
+            assert_eq!(requests[0].create_bucket_configuration, None);
+        }
+    }
+
+    #[test]
+    fn bucket_already_owned_is_created() {
+        let ds_list = vec!["ds1".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get("ds1").unwrap();
+
+        let res = create_bucket_with(ds, |_| {
+            result(Err(RusotoError::Service(
+                rusoto_s3::CreateBucketError::BucketAlreadyOwnedByYou("".to_string()),
+            )))
+        })
+        .wait();
+
+        assert!(res.is_ok());
+    }
+
+    #[test]
+    fn bucket_creation_failed() {
+        let ds_list = vec!["ds1".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let ds = cfg.datastore.get("ds1").unwrap();
+
+        let res = create_bucket_with(ds, |_| {
+            result(Err(RusotoError::Service(
+                rusoto_s3::CreateBucketError::BucketAlreadyExists("".to_string()),
+            )))
+        })
+        .wait();
+
+        match res {
+            Err(StorageError::Operation(CreateBucketError::Create(_))) => (),
+            other => panic!("Bucket creation should have failed: {:?}", other),
+        }
+    }
+
+    #[test]
+    fn requested_datastore_selected() {
+        let ds_list = vec!["ds1".to_string(), "ds2".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+
+        for _ in 0..10 {
+            let ds = select_datastore(&cfg, "mylog", Some("ds2"), None).unwrap();
+            assert_eq!(ds.name, Some("ds2".to_string()));
+        }
+        assert!(select_datastore(&cfg, "mylog", None, None).is_some());
+    }
+
+    #[test]
+    fn requested_datastore_not_in_log() {
+        let ds_list = vec!["ds1".to_string()];
+        let mut cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+        let mut other = cfg.datastore.get("ds1").unwrap().clone();
+        other.name = Some("other".to_string());
+        cfg.datastore.insert("other".to_string(), other);
+
+        assert_eq!(select_datastore(&cfg, "mylog", Some("other"), None), None);
+        assert_eq!(select_datastore(&cfg, "mylog", Some("missing"), None), None);
+    }
+
+    #[test]
+    fn idempotent_writes_select_same_datastore() {
+        let ds_list = vec!["ds1".to_string(), "ds2".to_string(), "ds3".to_string()];
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+
+        let first = select_datastore(&cfg, "mylog", None, Some("batch-42")).unwrap();
+        for _ in 0..10 {
+            let ds = select_datastore(&cfg, "mylog", None, Some("batch-42")).unwrap();
+            assert_eq!(ds.name, first.name);
+        }
+    }
+
+    #[test]
+    fn idempotent_writes_share_object_name() {
+        let now = Utc::now();
+        let first = object_name_for("mylog", now, Some("batch-42"));
+        // a retry with the same key overwrites the object instead of adding one
+        assert_eq!(first, object_name_for("mylog", now, Some("batch-42")));
+        assert_ne!(first, object_name_for("mylog", now, Some("batch-43")));
+        assert!(first.starts_with("minsql/mylog/"));
+        assert!(first.ends_with(".log"));
+    }
+
+    #[test]
+    fn writes_without_key_get_unique_object_names() {
+        let now = Utc::now();
+        assert_ne!(
+            object_name_for("mylog", now, None),
+            object_name_for("mylog", now, None)
+        );
+    }
+
+    #[test]
+    fn no_random_datastore_for_log_without_datastores() {
+        let ds_list: Vec<String> = Vec::new();
+        let cfg = get_ds_log_config_for("mylog".to_string(), &ds_list);
+
+        assert_eq!(rand_datastore(&cfg, "mylog"), None);
+    }
+
     #[test]
     fn fail_random_datastore_selected() {
         let ds_list = vec!["ds1".to_string(), "ds2".to_string()];